@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tdabry/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/tdabry/learn-pub-sub-starter/internal/pubsub"
+)
+
+// Exit codes of a script run.
+const (
+	scriptPassed = 0
+	scriptFailed = 1
+	scriptBroken = 2
+)
+
+// errSyntax marks a script line that could never pass, as opposed to one
+// that failed against the game.
+var errSyntax = errors.New("syntax")
+
+// replies records the StateDeltas answering this player's intents, so a
+// script can wait for the answer to the intent it just sent.
+type replies struct {
+	mu      sync.Mutex
+	n       int
+	last    gamelogic.StateDelta
+	changed chan struct{}
+}
+
+func newReplies() *replies {
+	return &replies{changed: make(chan struct{})}
+}
+
+func (r *replies) add(d gamelogic.StateDelta) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.n++
+	r.last = d
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+func (r *replies) get() (int, gamelogic.StateDelta, <-chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.n, r.last, r.changed
+}
+
+// await waits for the reply after the n-th.
+func (r *replies) await(n int, timeout time.Duration) (gamelogic.StateDelta, error) {
+	deadline := time.After(timeout)
+	for {
+		got, last, changed := r.get()
+		if got > n {
+			return last, nil
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return gamelogic.StateDelta{}, fmt.Errorf("no answer from the server within %s", timeout)
+		}
+	}
+}
+
+// script runs a file of client commands without a prompt. Besides the
+// REPL's spawn, move, status and spam it takes:
+//
+//	reset                    give up the army and start over
+//	wait <duration>          sleep
+//	wait <condition>         wait until condition holds
+//	expect <condition>       fail unless condition holds now
+//	quit                     stop, passing
+//
+// and conditions are
+//
+//	units [location] <n>     the player has n units (in location)
+//	unit <id> <location>     unit id is in location
+//	paused | playing
+//	accepted | rejected      the server's answer to the last intent
+//
+// Intents wait for the server's answer before the next line runs. Blank
+// lines and lines starting with # are skipped.
+type script struct {
+	gs       *gamelogic.GameState
+	pub      pubsub.Publisher
+	exchange string
+	replies  *replies
+	spam     func(n int64)
+	timeout  time.Duration
+	out      io.Writer
+}
+
+// run executes the script read from r and returns the process exit code:
+// 0 if every line passed, 1 at the first line that failed and 2 if the
+// script cannot be read or a line makes no sense.
+func (s *script) run(name string, r io.Reader) int {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		words := strings.Fields(scanner.Text())
+		if len(words) == 0 || strings.HasPrefix(words[0], "#") {
+			continue
+		}
+		fmt.Fprintf(s.out, "%s:%d: %s\n", name, line, strings.Join(words, " "))
+		if words[0] == "quit" {
+			break
+		}
+		if err := s.exec(words); errors.Is(err, errSyntax) {
+			fmt.Fprintf(s.out, "%s:%d: %v\n", name, line, err)
+			return scriptBroken
+		} else if err != nil {
+			fmt.Fprintf(s.out, "FAIL %s:%d: %v\n", name, line, err)
+			return scriptFailed
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(s.out, "%s: %v\n", name, err)
+		return scriptBroken
+	}
+	fmt.Fprintf(s.out, "PASS %s\n", name)
+	return scriptPassed
+}
+
+func (s *script) exec(words []string) error {
+	switch words[0] {
+	case "spawn":
+		in, err := s.gs.CommandSpawnIntent(words)
+		if err != nil {
+			return err
+		}
+		return s.send(in)
+	case "move":
+		in, err := s.gs.CommandMoveIntent(words)
+		if err != nil {
+			return err
+		}
+		return s.send(in)
+	case "reset":
+		return s.send(gamelogic.Intent{Username: s.gs.GetUsername(), Kind: gamelogic.IntentReset})
+	case "status":
+		s.gs.CommandStatus()
+		return nil
+	case "spam":
+		n, err := getSpamCount(words[1:])
+		if err != nil {
+			return fmt.Errorf("%w: %v", errSyntax, err)
+		}
+		s.spam(n)
+		return nil
+	case "wait":
+		if len(words) == 2 {
+			if d, err := time.ParseDuration(words[1]); err == nil {
+				time.Sleep(d)
+				return nil
+			}
+		}
+		return s.wait(words[1:])
+	case "expect":
+		check, err := s.condition(words[1:])
+		if err != nil {
+			return err
+		}
+		return check()
+	}
+	return fmt.Errorf("%w: unknown command %q", errSyntax, words[0])
+}
+
+// send publishes in and waits for the server to answer it. A rejection is
+// not an error; expect rejected checks for it.
+func (s *script) send(in gamelogic.Intent) error {
+	n, _, _ := s.replies.get()
+	if err := sendIntent(s.pub, s.exchange, in); err != nil {
+		return fmt.Errorf("%s was not delivered: %v", in.Kind, err)
+	}
+	_, err := s.replies.await(n, s.timeout)
+	return err
+}
+
+// wait polls condition until it holds or the script's timeout passes.
+func (s *script) wait(condition []string) error {
+	check, err := s.condition(condition)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(s.timeout)
+	for {
+		err := check()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("still not true after %s: %v", s.timeout, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// condition parses words into a check of the player's current state.
+func (s *script) condition(words []string) (func() error, error) {
+	if len(words) == 0 {
+		return nil, fmt.Errorf("%w: missing condition", errSyntax)
+	}
+	switch {
+	case words[0] == "units" && (len(words) == 2 || len(words) == 3):
+		want, err := strconv.Atoi(words[len(words)-1])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s is not a number", errSyntax, words[len(words)-1])
+		}
+		var loc gamelogic.Location
+		if len(words) == 3 {
+			loc = gamelogic.Location(words[1])
+		}
+		return func() error {
+			got := 0
+			for _, u := range s.gs.GetPlayerSnap().Units {
+				if loc == "" || u.Location == loc {
+					got++
+				}
+			}
+			if got != want {
+				if loc != "" {
+					return fmt.Errorf("%d unit(s) in %s, want %d", got, loc, want)
+				}
+				return fmt.Errorf("%d unit(s), want %d", got, want)
+			}
+			return nil
+		}, nil
+	case words[0] == "unit" && len(words) == 3:
+		id, err := strconv.Atoi(words[1])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s is not a unit ID", errSyntax, words[1])
+		}
+		loc := gamelogic.Location(words[2])
+		return func() error {
+			u, ok := s.gs.GetUnit(id)
+			if !ok {
+				return fmt.Errorf("no unit %d", id)
+			}
+			if u.Location != loc {
+				return fmt.Errorf("unit %d is in %s, want %s", id, u.Location, loc)
+			}
+			return nil
+		}, nil
+	case (words[0] == "paused" || words[0] == "playing") && len(words) == 1:
+		want := words[0] == "paused"
+		return func() error {
+			if s.gs.Snapshot().Paused != want {
+				return fmt.Errorf("the game is not %s", words[0])
+			}
+			return nil
+		}, nil
+	case (words[0] == "accepted" || words[0] == "rejected") && len(words) == 1:
+		want := words[0] == "rejected"
+		return func() error {
+			n, last, _ := s.replies.get()
+			refused := last.Rejected != ""
+			switch {
+			case n == 0:
+				return errors.New("the server has not answered an intent yet")
+			case want && !refused:
+				return fmt.Errorf("the server accepted the last %s", last.Kind)
+			case !want && refused:
+				return fmt.Errorf("the server refused the last %s: %s", last.Kind, last.Rejected)
+			}
+			return nil
+		}, nil
+	}
+	return nil, fmt.Errorf("%w: unknown condition %q", errSyntax, strings.Join(words, " "))
+}
+
+// runScript joins the game as a fresh client would, runs the script at
+// path ("-" for stdin) and calls stop before returning its exit code.
+func runScript(path string, s *script, stop func()) int {
+	defer stop()
+	r := io.Reader(os.Stdin)
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(s.out, err)
+			return scriptBroken
+		}
+		defer f.Close()
+		r = f
+	}
+	if err := s.send(gamelogic.Intent{Username: s.gs.GetUsername(), Kind: gamelogic.IntentJoin}); err != nil {
+		fmt.Fprintf(s.out, "FAIL could not join: %v\n", err)
+		return scriptFailed
+	}
+	return s.run(path, r)
+}
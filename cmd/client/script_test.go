@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/tdabry/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/tdabry/learn-pub-sub-starter/internal/routing"
+)
+
+// fakeServer is a Publisher that answers intents the way the server does,
+// from a World, straight into the client's game state and replies. A
+// silent one never answers.
+type fakeServer struct {
+	world   *gamelogic.World
+	gs      *gamelogic.GameState
+	replies *replies
+	silent  bool
+
+	mu      sync.Mutex
+	intents []gamelogic.Intent
+}
+
+func (f *fakeServer) PublishWithContext(_ context.Context, _, key string, _, _ bool, msg amqp.Publishing) error {
+	var in gamelogic.Intent
+	if err := json.Unmarshal(msg.Body, &in); err != nil {
+		return err
+	}
+	if key != routing.IntentKey(in.Username) {
+		return fmt.Errorf("intent by %s sent under %s", in.Username, key)
+	}
+	f.mu.Lock()
+	f.intents = append(f.intents, in)
+	f.mu.Unlock()
+	if f.silent {
+		return nil
+	}
+	d := f.world.Apply(in).Delta
+	f.gs.ApplyDelta(d)
+	f.replies.add(d)
+	return nil
+}
+
+// newScript returns a script for bob against a fake server, and the
+// buffer its output goes to.
+func newScript(t *testing.T) (*script, *fakeServer, *bytes.Buffer) {
+	t.Helper()
+	gs := gamelogic.NewGameState("bob")
+	srv := &fakeServer{world: gamelogic.NewWorld(nil), gs: gs, replies: newReplies()}
+	var out bytes.Buffer
+	return &script{gs: gs, pub: srv, exchange: "peril_topic", replies: srv.replies,
+		spam: func(int64) {}, timeout: 200 * time.Millisecond, out: &out}, srv, &out
+}
+
+func writeScript(t *testing.T, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.peril")
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRunScript(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		// paused pauses the server's world, so it refuses moves.
+		paused bool
+		silent bool
+		want   int
+		output string
+	}{
+		{
+			name: "passes",
+			script: `# spawn and move a unit
+spawn europe infantry
+expect accepted
+expect units 1
+
+expect units europe 1
+wait unit 1 europe
+move asia 1
+expect accepted
+expect unit 1 asia
+expect units europe 0
+expect playing
+wait 10ms
+status
+reset
+expect units 0
+`,
+			want:   scriptPassed,
+			output: "PASS",
+		},
+		{
+			name:   "quit stops passing",
+			script: "spawn europe infantry\nquit\nexpect units 5\n",
+			want:   scriptPassed,
+			output: "test.peril:2: quit\nPASS",
+		},
+		{
+			name:   "failed expect",
+			script: "spawn europe infantry\nexpect units 2\nexpect units 1\n",
+			want:   scriptFailed,
+			output: "FAIL test.peril:2: 1 unit(s), want 2",
+		},
+		{
+			name:   "expect rejected",
+			script: "spawn europe infantry\nmove asia 1\nexpect rejected\nexpect unit 1 europe\n",
+			paused: true,
+			want:   scriptPassed,
+		},
+		{
+			name:   "expect accepted of a refused intent",
+			script: "spawn europe infantry\nmove asia 1\nexpect accepted\n",
+			paused: true,
+			want:   scriptFailed,
+			output: "FAIL test.peril:3: the server refused the last move: the game is paused",
+		},
+		{
+			name:   "expect rejected of an accepted intent",
+			script: "spawn europe infantry\nexpect rejected\n",
+			want:   scriptFailed,
+			output: "the server accepted the last spawn",
+		},
+		{
+			name:   "wait times out",
+			script: "wait paused\n",
+			want:   scriptFailed,
+			output: "FAIL test.peril:1: still not true after 200ms: the game is not paused",
+		},
+		{
+			name:   "invalid intent",
+			script: "move asia 7\n",
+			want:   scriptFailed,
+			output: "unit with ID 7 not found",
+		},
+		{
+			name:   "no answer to join",
+			script: "expect units 0\n",
+			silent: true,
+			want:   scriptFailed,
+			output: "FAIL could not join: no answer from the server within 200ms",
+		},
+		{name: "unknown command", script: "spawn europe infantry\nfly asia\nexpect units 1\n", want: scriptBroken, output: `test.peril:2: syntax: unknown command "fly"`},
+		{name: "unknown condition", script: "expect happy\n", want: scriptBroken, output: `unknown condition "happy"`},
+		{name: "missing condition", script: "wait\n", want: scriptBroken, output: "missing condition"},
+		{name: "bad count", script: "expect units lots\n", want: scriptBroken, output: "lots is not a number"},
+		{name: "bad unit", script: "expect unit one europe\n", want: scriptBroken, output: "one is not a unit ID"},
+		{name: "extra words", script: "expect accepted now\n", want: scriptBroken},
+		{name: "bad duration", script: "wait 5 parsecs\n", want: scriptBroken},
+		{name: "bad spam", script: "spam lots\n", want: scriptBroken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, srv, out := newScript(t)
+			srv.world.SetPaused(tt.paused)
+			srv.silent = tt.silent
+			stopped := false
+			path := writeScript(t, tt.script)
+			got := runScript(path, s, func() { stopped = true })
+			output := strings.ReplaceAll(out.String(), filepath.Dir(path)+string(filepath.Separator), "")
+			if got != tt.want {
+				t.Errorf("exit code %d, want %d; output:\n%s", got, tt.want, output)
+			}
+			if !strings.Contains(output, tt.output) {
+				t.Errorf("output does not contain %q:\n%s", tt.output, output)
+			}
+			if !stopped {
+				t.Error("stop not called")
+			}
+			if len(srv.intents) == 0 || srv.intents[0].Kind != gamelogic.IntentJoin {
+				t.Errorf("sent %+v, want a join first", srv.intents)
+			}
+		})
+	}
+}
+
+func TestRunScriptMissingFile(t *testing.T) {
+	s, srv, out := newScript(t)
+	stopped := false
+	if got := runScript(filepath.Join(t.TempDir(), "missing.peril"), s, func() { stopped = true }); got != scriptBroken {
+		t.Errorf("exit code %d, want %d; output:\n%s", got, scriptBroken, out)
+	}
+	if !stopped || len(srv.intents) != 0 {
+		t.Errorf("stopped %v after sending %+v, want stopped before joining", stopped, srv.intents)
+	}
+}
+
+// TestScriptSendTimeout runs intents against a server that stops
+// answering after the join.
+func TestScriptSendTimeout(t *testing.T) {
+	s, srv, out := newScript(t)
+	path := writeScript(t, "spawn europe infantry\nexpect units 1\n")
+	got := runScript(path, s, func() {})
+	if got != scriptPassed {
+		t.Fatalf("exit code %d; output:\n%s", got, out)
+	}
+	srv.silent = true
+	out.Reset()
+	start := time.Now()
+	got = runScript(path, s, func() {})
+	if got != scriptFailed || !strings.Contains(out.String(), "could not join") {
+		t.Errorf("exit code %d, want %d; output:\n%s", got, scriptFailed, out)
+	}
+	if waited := time.Since(start); waited < s.timeout {
+		t.Errorf("gave up after %v, before the %v timeout", waited, s.timeout)
+	}
+
+	// Answered join, silent spawn.
+	s, srv, out = newScript(t)
+	srv.silent = true
+	srv.replies.add(gamelogic.StateDelta{Username: "bob", Kind: gamelogic.IntentJoin})
+	if got := s.run("test.peril", strings.NewReader("spawn europe infantry\nexpect units 1\n")); got != scriptFailed {
+		t.Errorf("exit code %d, want %d", got, scriptFailed)
+	}
+	if want := "FAIL test.peril:1: no answer from the server within 200ms"; !strings.Contains(out.String(), want) {
+		t.Errorf("output does not contain %q:\n%s", want, out)
+	}
+}
+
+// TestScriptWait waits for state that the subscriptions change while the
+// script runs.
+func TestScriptWait(t *testing.T) {
+	s, _, out := newScript(t)
+	s.timeout = 2 * time.Second
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.gs.HandlePause(routing.PlayingState{IsPaused: true})
+	}()
+	if got := s.run("test.peril", strings.NewReader("expect playing\nwait paused\nexpect paused\n")); got != scriptPassed {
+		t.Errorf("exit code %d; output:\n%s", got, out)
+	}
+}
+
+func TestScriptAnswerConditions(t *testing.T) {
+	s, _, out := newScript(t)
+	if got := s.run("test.peril", strings.NewReader("expect accepted\n")); got != scriptFailed {
+		t.Errorf("exit code %d, want %d", got, scriptFailed)
+	}
+	if want := "the server has not answered an intent yet"; !strings.Contains(out.String(), want) {
+		t.Errorf("output does not contain %q:\n%s", want, out)
+	}
+}
+
+func TestScriptSpam(t *testing.T) {
+	s, _, out := newScript(t)
+	var spammed []int64
+	s.spam = func(n int64) { spammed = append(spammed, n) }
+	if got := s.run("test.peril", strings.NewReader("spam 3\nspam 40\n")); got != scriptPassed {
+		t.Errorf("exit code %d; output:\n%s", got, out)
+	}
+	if len(spammed) != 2 || spammed[0] != 3 || spammed[1] != 40 {
+		t.Errorf("spammed %v, want [3 40]", spammed)
+	}
+}
@@ -0,0 +1,226 @@
+// Command dlq lists and replays the messages in Peril's dead letter queue.
+//
+//	dlq [-broker url] list [-n max]
+//	dlq [-broker url] replay [-from queue] [-all | message-id...]
+//
+// Replayed messages keep their signatures, so signed ones are only
+// accepted again while they are younger than pubsub.MaxMessageAge. The
+// subscriber does not take them for replay attacks: pubsub.Verify forgets
+// a message once its handler has discarded it.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/tdabry/learn-pub-sub-starter/internal/config"
+	"github.com/tdabry/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/tdabry/learn-pub-sub-starter/internal/pubsub"
+	"github.com/tdabry/learn-pub-sub-starter/internal/routing"
+	"github.com/tdabry/learn-pub-sub-starter/internal/topology"
+)
+
+// bodyTypes maps the Type property Publish stamps on messages to the
+// value to decode their bodies into.
+var bodyTypes = map[string]func() any{
+	"routing.PlayingState":       func() any { return new(routing.PlayingState) },
+	"routing.GameLog":            func() any { return new(routing.GameLog) },
+	"routing.Moderation":         func() any { return new(routing.Moderation) },
+	"gamelogic.ArmyMove":         func() any { return new(gamelogic.ArmyMove) },
+	"gamelogic.RecognitionOfWar": func() any { return new(gamelogic.RecognitionOfWar) },
+	"gamelogic.WarResolved":      func() any { return new(gamelogic.WarResolved) },
+	"gamelogic.Intent":           func() any { return new(gamelogic.Intent) },
+	"gamelogic.StateDelta":       func() any { return new(gamelogic.StateDelta) },
+}
+
+func main() {
+	loader := config.Bind(flag.CommandLine, config.BrokerKeys...)
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: dlq [-broker url] list [-n max]")
+		fmt.Fprintln(os.Stderr, "       dlq [-broker url] replay [-from queue] [-all | message-id...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cfg, err := loader.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	conn, err := cfg.Broker.Connect()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	args := flag.Args()
+	switch args[0] {
+	case "list":
+		err = list(conn, args[1:])
+	case "replay":
+		err = replay(conn, cfg.Exchanges, args[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func list(conn pubsub.Broker, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	n := fs.Int("n", 0, "show at most n messages (0 for all)")
+	fs.Parse(args)
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	// Only look: a passive declare fails if the queue is missing instead
+	// of creating it.
+	if _, err := ch.QueueDeclarePassive(routing.QueuePerilDead, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("dead letter queue %s: %w", routing.QueuePerilDead, err)
+	}
+	letters, err := fetch(ch, *n)
+	defer requeue(letters)
+	if err != nil {
+		return err
+	}
+	for _, dl := range letters {
+		printLetter(dl)
+	}
+	fmt.Printf("%d message(s)\n", len(letters))
+	return nil
+}
+
+func replay(conn pubsub.Broker, ex routing.Exchanges, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	all := fs.Bool("all", false, "replay every message")
+	from := fs.String("from", "", "only replay messages dead-lettered from this queue")
+	fs.Parse(args)
+	ids := map[string]bool{}
+	for _, id := range fs.Args() {
+		ids[id] = true
+	}
+	if !*all && *from == "" && len(ids) == 0 {
+		return fmt.Errorf("replay: give message ids, -from or -all")
+	}
+	if err := topology.Peril(ex).Declare(conn, nil); err != nil {
+		return err
+	}
+
+	pub, err := pubsub.NewConfirmedPublisher(conn)
+	if err != nil {
+		return err
+	}
+	defer pub.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	letters, err := fetch(ch, 0)
+	if err != nil {
+		requeue(letters)
+		return err
+	}
+
+	var kept []pubsub.DeadLetter
+	replayed := 0
+	for _, dl := range letters {
+		chosen := *all || ids[dl.MessageId] || len(ids) == 0
+		if *from != "" && dl.Queue != *from {
+			chosen = false
+		}
+		if !chosen {
+			kept = append(kept, dl)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := dl.Replay(ctx, pub)
+		cancel()
+		if err != nil {
+			log.Printf("replaying %s: %v", dl.MessageId, err)
+			kept = append(kept, dl)
+			continue
+		}
+		dl.Ack(false)
+		replayed++
+		fmt.Printf("replayed %s to %s %q\n", dl.MessageId, exchangeName(dl.OriginalExchange), dl.OriginalRoutingKey)
+	}
+	requeue(kept)
+	fmt.Printf("%d message(s) replayed, %d left\n", replayed, len(kept))
+	return nil
+}
+
+// fetch takes up to max messages (all of them if max is 0) off the dead
+// letter queue without acking them. The caller settles each one.
+func fetch(ch pubsub.Channel, max int) ([]pubsub.DeadLetter, error) {
+	var letters []pubsub.DeadLetter
+	for max == 0 || len(letters) < max {
+		d, ok, err := ch.Get(routing.QueuePerilDead, false)
+		if err != nil {
+			return letters, err
+		}
+		if !ok {
+			break
+		}
+		letters = append(letters, pubsub.ParseDeadLetter(d))
+	}
+	return letters, nil
+}
+
+// requeue puts the letters back, last first, so they keep their order at
+// the head of the queue.
+func requeue(letters []pubsub.DeadLetter) {
+	for i := len(letters) - 1; i >= 0; i-- {
+		letters[i].Nack(false, true)
+	}
+}
+
+func printLetter(dl pubsub.DeadLetter) {
+	fmt.Printf("%s %s\n", dl.MessageId, dl.Type)
+	fmt.Printf("  %s from %s (x%d) at %s\n", dl.Reason, dl.Queue, dl.Count, dl.Time.Format(time.RFC3339))
+	fmt.Printf("  published to %s %q", exchangeName(dl.OriginalExchange), dl.OriginalRoutingKey)
+	if attempts, ok := dl.Headers[pubsub.HeaderAttempts]; ok {
+		fmt.Printf(", %v retries", attempts)
+	}
+	fmt.Println()
+	fmt.Printf("  %s\n", describe(dl.Delivery))
+}
+
+// describe decodes the body with the codec for its content type, falling
+// back to the raw bytes for types it does not know.
+func describe(d amqp.Delivery) string {
+	codec, ok := pubsub.CodecFor(d.ContentType)
+	newBody, known := bodyTypes[d.Type]
+	if !ok || !known {
+		return fmt.Sprintf("%s, %d bytes: %q", d.ContentType, len(d.Body), d.Body)
+	}
+	body := newBody()
+	if err := codec.Unmarshal(d.Body, body); err != nil {
+		return fmt.Sprintf("%s, undecodable: %v", d.ContentType, err)
+	}
+	out, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Sprintf("%+v", body)
+	}
+	return fmt.Sprintf("%s: %s", d.ContentType, out)
+}
+
+func exchangeName(name string) string {
+	if name == "" {
+		return "(default)"
+	}
+	return name
+}
@@ -0,0 +1,62 @@
+// Command logs searches the game logs the server has stored.
+//
+//	logs [-file game.log | -sqlite logs.db] [-user u] [-since t] [-until t] [-f] [-json] [text...]
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"github.com/tdabry/learn-pub-sub-starter/internal/logsink"
+	"github.com/tdabry/learn-pub-sub-starter/internal/routing"
+)
+
+func main() {
+	file := flag.String("file", "game.log", "text or JSON-lines log file written by the server")
+	sqlite := flag.String("sqlite", "", "SQLite database written by the server, instead of -file")
+	var qf logsink.QueryFlags
+	qf.Register(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: logs [-file path | -sqlite path] [-user u] [-since t] [-until t] [-f] [-json] [text...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if err := qf.Resolve(flag.Args(), time.Now()); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	show := func(lg routing.GameLog) error {
+		return qf.Print(os.Stdout, lg)
+	}
+
+	var err error
+	if *sqlite != "" {
+		var db *sql.DB
+		if db, err = sql.Open("sqlite", logsink.SQLiteDSN(*sqlite)); err != nil {
+			log.Fatal(err)
+		}
+		defer db.Close()
+		if qf.Follow {
+			err = logsink.FollowSQL(ctx, db, qf.Query, show)
+		} else {
+			_, err = logsink.SearchSQL(ctx, db, qf.Query, 0, show)
+		}
+	} else if qf.Follow {
+		err = logsink.FollowFile(ctx, *file, qf.Query, show)
+	} else {
+		err = logsink.SearchFile(ctx, *file, qf.Query, show)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
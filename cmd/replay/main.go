@@ -0,0 +1,83 @@
+// Command replay rebuilds a player's game state from the server's event
+// log, optionally stopping at a sequence number or a point in time.
+//
+//	replay [-events events.jsonl] [-seq n] [-at time] username
+//	replay [-events events.jsonl] -list [username]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/tdabry/learn-pub-sub-starter/internal/eventlog"
+)
+
+func main() {
+	path := flag.String("events", "events.jsonl", "event log written by the server")
+	seq := flag.Uint64("seq", 0, "stop after this event")
+	at := flag.String("at", "", "stop at this time (RFC 3339)")
+	list := flag.Bool("list", false, "only list the events, for username if given")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: replay [-events file] [-seq n] [-at time] username")
+		fmt.Fprintln(os.Stderr, "       replay [-events file] -list [username]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	until := eventlog.Until{Seq: *seq}
+	if *at != "" {
+		t, err := time.Parse(time.RFC3339, *at)
+		if err != nil {
+			log.Fatalf("-at: %v", err)
+		}
+		until.Time = t
+	}
+	username := flag.Arg(0)
+
+	if *list {
+		err := eventlog.Read(*path, func(e eventlog.Event) error {
+			if username == "" || involves(e, username) {
+				fmt.Println(e)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if username == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var last eventlog.Event
+	gs, err := eventlog.Replay(*path, username, until, func(e eventlog.Event) {
+		if involves(e, username) {
+			fmt.Println(e)
+		}
+		last = e
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println()
+	fmt.Printf("==== State after event #%d (%s) ====\n", last.Seq, last.Time.Format(time.RFC3339))
+	gs.CommandStatus()
+}
+
+// involves reports whether e concerns username. Pauses concern everyone.
+func involves(e eventlog.Event, username string) bool {
+	switch {
+	case e.Username == username, e.Pause != nil:
+		return true
+	case e.War != nil:
+		return e.War.Defender.Username == username
+	case e.WarResolved != nil:
+		return e.WarResolved.Defender == username
+	}
+	return false
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"github.com/tdabry/learn-pub-sub-starter/internal/keystore"
+	"github.com/tdabry/learn-pub-sub-starter/internal/pubsub"
+)
+
+// serverSigner is the name the server signs its own messages as.
+const serverSigner = keystore.ServerName
+
+// keyOwner reads the owner of a message from the key it was signed under.
+func keyOwner(parse func(key string) (string, bool)) pubsub.Owner {
+	return func(md pubsub.Metadata) (string, bool) {
+		return parse(md.SignedKey())
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tdabry/learn-pub-sub-starter/internal/moderation"
+)
+
+// userQuotas is the repeatable -log-quota flag, user=rate:burst.
+type userQuotas map[string]moderation.Quota
+
+func (u userQuotas) String() string {
+	var s []string
+	for name, q := range u {
+		s = append(s, name+"="+q.String())
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func (u userQuotas) Set(v string) error {
+	name, quota, ok := strings.Cut(v, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("%q is not user=rate:burst", v)
+	}
+	q, err := moderation.ParseQuota(quota)
+	if err != nil {
+		return err
+	}
+	u[name] = q
+	return nil
+}
+
+func printOffenders(mod *moderation.Moderator) {
+	strikes := mod.Strikes()
+	if len(strikes) == 0 {
+		fmt.Println("No player has been flagged.")
+		return
+	}
+	names := make([]string, 0, len(strikes))
+	for name := range strikes {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return strikes[names[i]] > strikes[names[j]] ||
+			strikes[names[i]] == strikes[names[j]] && names[i] < names[j]
+	})
+	for _, name := range names {
+		fmt.Printf("%s: flagged %d time(s)\n", name, strikes[name])
+	}
+}
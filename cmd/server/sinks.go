@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"github.com/tdabry/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/tdabry/learn-pub-sub-starter/internal/logsink"
+	"github.com/tdabry/learn-pub-sub-starter/internal/routing"
+)
+
+// sinkFlags holds the -log-* flags choosing where game logs are written.
+type sinkFlags struct {
+	file     string
+	jsonl    string
+	sqlite   string
+	stdout   bool
+	rotation logsink.Rotation
+}
+
+// open returns the sink for every configured -log-* flag, and the one the
+// logs REPL command searches: SQLite if set, then JSON lines, then text.
+func (f sinkFlags) open() (logsink.Sink, logsink.Searcher, error) {
+	var sinks []logsink.Sink
+	var search logsink.Searcher
+	fail := func(err error) (logsink.Sink, logsink.Searcher, error) {
+		for _, s := range sinks {
+			s.Close()
+		}
+		return nil, nil, err
+	}
+	if f.file != "" {
+		s, err := logsink.NewFileSink(f.file, f.rotation)
+		if err != nil {
+			return fail(err)
+		}
+		sinks, search = append(sinks, s), s
+	}
+	if f.jsonl != "" {
+		s, err := logsink.NewJSONLSink(f.jsonl, f.rotation)
+		if err != nil {
+			return fail(err)
+		}
+		sinks, search = append(sinks, s), s
+	}
+	if f.sqlite != "" {
+		db, err := sql.Open("sqlite", logsink.SQLiteDSN(f.sqlite))
+		if err != nil {
+			return fail(err)
+		}
+		s, err := logsink.NewSQLSink(db)
+		if err != nil {
+			db.Close()
+			return fail(err)
+		}
+		sinks, search = append(sinks, s), s
+	}
+	if f.stdout {
+		sinks = append(sinks, logsink.Stdout())
+	}
+	if len(sinks) == 0 {
+		return nil, nil, errors.New("no game log sink: set -log-file, -log-jsonl, -log-sqlite or -log-stdout")
+	}
+	return logsink.Multi(sinks...), search, nil
+}
+
+// queryLogs runs the logs REPL command. With -f it follows new logs until
+// Enter is pressed.
+func queryLogs(search logsink.Searcher, args []string) {
+	if search == nil {
+		fmt.Println("no searchable game log sink: set -log-file, -log-jsonl or -log-sqlite")
+		return
+	}
+	fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+	var qf logsink.QueryFlags
+	qf.Register(fs)
+	if err := fs.Parse(args); err != nil {
+		return
+	}
+	if err := qf.Resolve(fs.Args(), time.Now()); err != nil {
+		fmt.Println(err)
+		return
+	}
+	show := func(lg routing.GameLog) error {
+		return qf.Print(os.Stdout, lg)
+	}
+	if !qf.Follow {
+		if err := search.Search(context.Background(), qf.Query, show); err != nil {
+			log.Print(err)
+		}
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- search.Follow(ctx, qf.Query, show) }()
+	fmt.Println("Following game logs, press Enter to stop.")
+	gamelogic.GetInput()
+	cancel()
+	if err := <-done; err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/tdabry/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/tdabry/learn-pub-sub-starter/internal/pubsub"
+	"github.com/tdabry/learn-pub-sub-starter/internal/routing"
+)
+
+// handlerIntent applies a player's intent to the world and publishes
+// what came of it: the delta for that player, the move for everyone to
+// see, and any wars the move started.
+func handlerIntent(world *gamelogic.World, ex routing.Exchanges, pub pubsub.Publisher) func(pubsub.Message[gamelogic.Intent]) pubsub.Acktype {
+	return func(msg pubsub.Message[gamelogic.Intent]) pubsub.Acktype {
+		in := msg.Body
+		if user, ok := routing.ParseIntentKey(msg.RoutingKey); !ok || user != in.Username {
+			log.Printf("dropping intent for %q sent under %s", in.Username, msg.RoutingKey)
+			return pubsub.NackDiscard
+		}
+		out := world.Apply(in)
+		trace := pubsub.WithCorrelationID(msg.TraceID())
+		if err := pubsub.PublishJSON(pub, ex.Topic,
+			routing.StateDeltaKey(in.Username), out.Delta, trace); err != nil {
+			log.Printf("state delta for %s not published: %v", in.Username, err)
+		}
+		if out.Move != nil {
+			if err := pubsub.PublishJSON(pub, ex.Topic,
+				routing.ArmyMoveKey(in.Username), *out.Move, trace); err != nil {
+				log.Printf("move by %s not published: %v", in.Username, err)
+			}
+		}
+		for _, rw := range out.Wars {
+			if err := pubsub.PublishJSON(pub, ex.Topic,
+				routing.WarKey(rw.Attacker.Username), rw, trace); err != nil {
+				log.Printf("war between %s and %s not published: %v",
+					rw.Attacker.Username, rw.Defender.Username, err)
+			}
+		}
+		return pubsub.Ack
+	}
+}
+
+// handlerWar resolves a war against the world and tells everyone the
+// outcome, so both sides apply the same casualties.
+func handlerWar(world *gamelogic.World, ex routing.Exchanges, pub pubsub.Publisher) func(pubsub.Message[gamelogic.RecognitionOfWar]) pubsub.Acktype {
+	return func(msg pubsub.Message[gamelogic.RecognitionOfWar]) pubsub.Acktype {
+		wr, ok := world.ResolveWar(msg.Body)
+		if !ok {
+			log.Printf("war between %s and %s called off: no shared location",
+				msg.Body.Attacker.Username, msg.Body.Defender.Username)
+			return pubsub.Ack
+		}
+		trace := pubsub.WithCorrelationID(msg.TraceID())
+		if err := pubsub.PublishJSON(pub, ex.Topic,
+			routing.WarResolvedKey(wr.Attacker), wr, trace); err != nil {
+			log.Printf("outcome of war in %s not published: %v", wr.Location, err)
+		}
+		logMsg := fmt.Sprintf("A war between %s and %s resulted in a draw", wr.Attacker, wr.Defender)
+		if wr.Winner != "" {
+			logMsg = fmt.Sprintf("%s won a war against %s", wr.Winner, wr.Loser)
+		}
+		// The server reports the war, so neither player's quota pays for it.
+		err := pubsub.PublishGob(pub, ex.Topic, routing.GameLogKey(serverSigner),
+			routing.GameLog{CurrentTime: time.Now(), Message: logMsg, Username: serverSigner}, trace)
+		if err != nil {
+			log.Printf("game log for war in %s not published: %v", wr.Location, err)
+		}
+		return pubsub.Ack
+	}
+}
+
+func saveWorld(world *gamelogic.World, path string) {
+	if err := writeWorld(world, path); err != nil {
+		log.Printf("could not save the world: %v", err)
+		return
+	}
+	log.Printf("world saved to %s", path)
+}
+
+func autosaveWorld(world *gamelogic.World, path string, every time.Duration) {
+	for range time.Tick(every) {
+		if err := writeWorld(world, path); err != nil {
+			log.Printf("autosave failed: %v", err)
+		}
+	}
+}
+
+// writeWorld saves a snapshot of world to path and, once it is on disk,
+// makes it the one players resume from.
+func writeWorld(world *gamelogic.World, path string) error {
+	snap := world.Snapshot()
+	if err := gamelogic.SaveSnapshot(path, snap); err != nil {
+		return err
+	}
+	world.Saved(snap)
+	return nil
+}
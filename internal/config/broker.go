@@ -0,0 +1,212 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/tdabry/learn-pub-sub-starter/internal/pubsub"
+)
+
+type Broker struct {
+	URL   string `json:"url,omitempty"`
+	VHost string `json:"vhost,omitempty"`
+	TLS   TLS    `json:"tls"`
+	Auth  string `json:"auth,omitempty"`
+	// Secure is for deployments: it rejects amqp:// URLs and the guest
+	// account, including the implicit one of a URL without credentials.
+	Secure bool `json:"secure,omitempty"`
+	// Management is the base URL of the RabbitMQ management API, with the
+	// credentials of a policymaker, which the server sets the queue
+	// policies through. Empty leaves the policies to an operator.
+	Management string `json:"management,omitempty"`
+}
+
+// TLS holds PEM file paths. CA replaces the system roots; Cert and Key are
+// the client certificate, if the broker asks for one.
+type TLS struct {
+	CA         string `json:"ca,omitempty"`
+	Cert       string `json:"cert,omitempty"`
+	Key        string `json:"key,omitempty"`
+	ServerName string `json:"server_name,omitempty"`
+}
+
+func (t TLS) Enabled() bool {
+	return t != TLS{}
+}
+
+const (
+	AuthPlain    = "plain"
+	AuthExternal = "external"
+)
+
+func (b Broker) validate() error {
+	if b.URL == pubsub.MemoryURL {
+		switch {
+		case b.Secure:
+			return errors.New("secure mode needs an amqps:// broker URL")
+		case b.VHost != "" || b.TLS.Enabled() || b.Auth == AuthExternal:
+			return errors.New("the in-process broker takes no vhost, TLS or auth settings")
+		}
+		return nil
+	}
+	u, err := url.Parse(b.URL)
+	if err != nil {
+		return fmt.Errorf("broker URL: %v", err)
+	}
+	var errs []error
+	switch u.Scheme {
+	case "amqp":
+		if b.Secure {
+			errs = append(errs, errors.New("secure mode needs an amqps:// broker URL"))
+		}
+		if b.TLS.Enabled() || b.Auth == AuthExternal {
+			errs = append(errs, errors.New("TLS settings need an amqps:// broker URL"))
+		}
+	case "amqps":
+		if _, err := b.TLS.config(); err != nil {
+			errs = append(errs, err)
+		}
+	default:
+		errs = append(errs, fmt.Errorf("broker URL %q is not amqp:// or amqps://", b.URL))
+	}
+	if (b.TLS.Cert == "") != (b.TLS.Key == "") {
+		errs = append(errs, errors.New("the TLS client certificate and key go together"))
+	}
+	switch b.Auth {
+	case "", AuthPlain:
+		if user := u.User.Username(); b.Secure && (user == "" || user == "guest") {
+			errs = append(errs, errors.New("secure mode does not allow the guest account"))
+		}
+	case AuthExternal:
+		if b.TLS.Cert == "" {
+			errs = append(errs, errors.New("external auth needs a TLS client certificate"))
+		}
+		if u.User != nil {
+			errs = append(errs, errors.New("external auth takes its identity from the certificate, not the URL"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("auth %q is not %s or %s", b.Auth, AuthPlain, AuthExternal))
+	}
+	return errors.Join(errs...)
+}
+
+func (t TLS) config() (*tls.Config, error) {
+	c := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: t.ServerName}
+	if t.CA != "" {
+		pem, err := os.ReadFile(t.CA)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no PEM certificates", t.CA)
+		}
+	}
+	if t.Cert != "" && t.Key != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// Address is the broker URL with VHost applied.
+func (b Broker) Address() string {
+	if b.VHost == "" || b.URL == pubsub.MemoryURL {
+		return b.URL
+	}
+	u, err := url.Parse(b.URL)
+	if err != nil {
+		return b.URL
+	}
+	u.Path = "/" + b.VHost
+	u.RawPath = "/" + url.PathEscape(b.VHost)
+	return u.String()
+}
+
+func (b Broker) validateManagement() error {
+	if b.Management == "" || b.URL == pubsub.MemoryURL {
+		return nil
+	}
+	u, err := url.Parse(b.Management)
+	if err != nil {
+		return fmt.Errorf("management URL: %v", err)
+	}
+	switch {
+	case u.Scheme != "http" && u.Scheme != "https":
+		return fmt.Errorf("management URL %q is not http:// or https://", b.Management)
+	case b.Secure && u.Scheme != "https":
+		return errors.New("secure mode needs an https:// management URL")
+	case b.Secure && (u.User.Username() == "" || u.User.Username() == "guest"):
+		return errors.New("secure mode does not allow the guest account on the management API")
+	}
+	return nil
+}
+
+// PolicyAdmin is the management API at b.Management for the vhost b
+// connects to, or nil if there is none. The in-process broker has no
+// policies to declare, so it gets nil too.
+func (b Broker) PolicyAdmin() (pubsub.PolicyAdmin, error) {
+	if b.Management == "" || b.URL == pubsub.MemoryURL {
+		return nil, nil
+	}
+	m := &pubsub.Management{URL: b.Management, VHost: b.VHost}
+	if m.VHost == "" {
+		if u, err := url.Parse(b.URL); err == nil {
+			m.VHost = strings.TrimPrefix(u.Path, "/")
+		}
+	}
+	if strings.HasPrefix(b.Management, "https:") {
+		tlsCfg, err := b.TLS.config()
+		if err != nil {
+			return nil, err
+		}
+		m.Client = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+	}
+	return m, nil
+}
+
+// AMQP is the connection settings for b: its TLS files for amqps, and the
+// EXTERNAL mechanism for external auth.
+func (b Broker) AMQP() (amqp.Config, error) {
+	var cfg amqp.Config
+	u, err := url.Parse(b.URL)
+	if err != nil || u.Scheme != "amqps" {
+		return cfg, err
+	}
+	if cfg.TLSClientConfig, err = b.TLS.config(); err != nil {
+		return cfg, err
+	}
+	if b.Auth == AuthExternal {
+		cfg.SASL = []amqp.Authentication{&amqp.ExternalAuth{}}
+	}
+	return cfg, nil
+}
+
+// Connect dials the broker once.
+func (b Broker) Connect() (pubsub.Broker, error) {
+	cfg, err := b.AMQP()
+	if err != nil {
+		return nil, err
+	}
+	return pubsub.ConnectConfig(b.Address(), cfg)
+}
+
+// DialManager dials the broker and keeps redialing it when the connection
+// drops.
+func (b Broker) DialManager() (*pubsub.Manager, error) {
+	cfg, err := b.AMQP()
+	if err != nil {
+		return nil, err
+	}
+	return pubsub.DialManagerConfig(b.Address(), cfg)
+}
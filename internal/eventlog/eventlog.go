@@ -0,0 +1,205 @@
+// Package eventlog records every gameplay event the server decides on, in
+// order, so any player's state can be rebuilt by replaying them.
+package eventlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tdabry/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/tdabry/learn-pub-sub-starter/internal/routing"
+)
+
+type Kind string
+
+const (
+	// KindState is a StateDelta: a join, spawn, move, resume or reset.
+	KindState       Kind = "state"
+	KindMove        Kind = "move"
+	KindWar         Kind = "war"
+	KindWarResolved Kind = "war_resolved"
+	KindPause       Kind = "pause"
+)
+
+// Event is one line of the log. Exactly one of the payload fields is set,
+// matching Kind.
+type Event struct {
+	Seq      uint64
+	Time     time.Time
+	Kind     Kind
+	Username string `json:",omitempty"`
+
+	State       *gamelogic.StateDelta       `json:",omitempty"`
+	Move        *gamelogic.ArmyMove         `json:",omitempty"`
+	War         *gamelogic.RecognitionOfWar `json:",omitempty"`
+	WarResolved *gamelogic.WarResolved      `json:",omitempty"`
+	Pause       *routing.PlayingState       `json:",omitempty"`
+}
+
+func (e Event) String() string {
+	s := fmt.Sprintf("#%d %s %s", e.Seq, e.Time.Format(time.RFC3339), e.Kind)
+	switch {
+	case e.State != nil && e.State.Rejected != "":
+		s += fmt.Sprintf(" %s %s rejected: %s", e.Username, e.State.Kind, e.State.Rejected)
+	case e.State != nil:
+		s += fmt.Sprintf(" %s %s %d unit(s)", e.Username, e.State.Kind, len(e.State.Units))
+	case e.Move != nil:
+		s += fmt.Sprintf(" %s moved %d unit(s) to %s", e.Username, len(e.Move.Units), e.Move.ToLocation)
+	case e.War != nil:
+		s += fmt.Sprintf(" %s declared war on %s", e.War.Attacker.Username, e.War.Defender.Username)
+	case e.WarResolved != nil:
+		wr := e.WarResolved
+		s += fmt.Sprintf(" %s vs %s in %s, winner %q, casualties %v",
+			wr.Attacker, wr.Defender, wr.Location, wr.Winner, wr.Casualties)
+	case e.Pause != nil:
+		s += fmt.Sprintf(" paused=%v", e.Pause.IsPaused)
+	}
+	return s
+}
+
+// Log appends events to a JSON-lines file. It is safe for concurrent use;
+// sequence numbers follow the order Append is called in.
+type Log struct {
+	mu   sync.Mutex
+	f    *os.File
+	w    *bufio.Writer
+	seq  uint64
+	path string
+}
+
+// Open opens the log at path for appending, creating it if needed, and
+// carries on numbering from its last event.
+func Open(path string) (*Log, error) {
+	var last uint64
+	err := Read(path, func(e Event) error {
+		last = e.Seq
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{f: f, w: bufio.NewWriter(f), seq: last, path: path}, nil
+}
+
+// Append stamps e with the next sequence number and the current time and
+// writes it out.
+func (l *Log) Append(e Event) (Event, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	e.Seq = l.seq
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return e, err
+	}
+	l.w.Write(data)
+	l.w.WriteByte('\n')
+	return e, l.w.Flush()
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.w.Flush(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
+
+var (
+	// ErrTruncated is a last line without its newline, as left by a crash
+	// in the middle of an Append.
+	ErrTruncated = errors.New("eventlog: truncated last event")
+	// ErrGap is an event whose sequence number does not follow the one
+	// before it, so events are missing or out of order.
+	ErrGap = errors.New("eventlog: sequence gap")
+)
+
+// Read calls fn for every event in the log at path, in order. It stops
+// with ErrTruncated or ErrGap rather than skip over a damaged log.
+func Read(path string, fn func(Event) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var prev uint64
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(data) == 0 {
+				return nil
+			}
+			return fmt.Errorf("%s:%d: %w", path, line, ErrTruncated)
+		}
+		if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(data)) == 0 {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal(data, &e); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if prev != 0 && e.Seq != prev+1 {
+			return fmt.Errorf("%s:%d: %w: #%d follows #%d", path, line, ErrGap, e.Seq, prev)
+		}
+		prev = e.Seq
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
+
+// Recorder returns a gamelogic.Recorder that appends what a World decides
+// to l. The world calls it while locked, so the log is in the order the
+// world changed.
+func (l *Log) Recorder() gamelogic.Recorder {
+	return recorder{l}
+}
+
+type recorder struct {
+	events *Log
+}
+
+func (r recorder) Applied(in gamelogic.Intent, out gamelogic.Outcome) {
+	r.record(Event{Kind: KindState, Username: in.Username, State: &out.Delta})
+	if out.Move != nil {
+		r.record(Event{Kind: KindMove, Username: in.Username, Move: out.Move})
+	}
+	for _, rw := range out.Wars {
+		r.record(Event{Kind: KindWar, Username: rw.Attacker.Username, War: &rw})
+	}
+}
+
+func (r recorder) Resolved(wr gamelogic.WarResolved) {
+	r.record(Event{Kind: KindWarResolved, Username: wr.Attacker, WarResolved: &wr})
+}
+
+func (r recorder) Paused(paused bool) {
+	r.record(Event{Kind: KindPause, Pause: &routing.PlayingState{IsPaused: paused}})
+}
+
+func (r recorder) record(e Event) {
+	if _, err := r.events.Append(e); err != nil {
+		log.Printf("could not record %s event: %v", e.Kind, err)
+	}
+}
@@ -0,0 +1,147 @@
+package eventlog
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tdabry/learn-pub-sub-starter/internal/gamelogic"
+)
+
+func apply(t *testing.T, w *gamelogic.World, in gamelogic.Intent) gamelogic.Outcome {
+	t.Helper()
+	out := w.Apply(in)
+	if out.Delta.Rejected != "" {
+		t.Fatalf("%s refused: %s", in.Kind, out.Delta.Rejected)
+	}
+	return out
+}
+
+// play runs a short game on a world recording to the log at path: spawns,
+// a move into a war and its resolution, a refused intent, a pause, a reset
+// and a rejoin.
+func play(t *testing.T, path string) *gamelogic.World {
+	t.Helper()
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	w := gamelogic.NewWorld(l.Recorder())
+	spawn := func(user string, loc gamelogic.Location, rank gamelogic.UnitRank) gamelogic.Unit {
+		return apply(t, w, gamelogic.Intent{Username: user, Kind: gamelogic.IntentSpawn, Location: loc, Rank: rank}).Delta.Units[0]
+	}
+	spawn("alice", "europe", gamelogic.RankInfantry)
+	spawn("alice", "asia", gamelogic.RankCavalry)
+	tank := spawn("bob", "africa", gamelogic.RankArtillery)
+	spawn("carol", "americas", gamelogic.RankInfantry)
+	out := apply(t, w, gamelogic.Intent{Username: "bob", Kind: gamelogic.IntentMove, Location: "europe", UnitIDs: []int{tank.ID}})
+	if len(out.Wars) != 1 {
+		t.Fatalf("wars %+v, want one", out.Wars)
+	}
+	if _, ok := w.ResolveWar(out.Wars[0]); !ok {
+		t.Fatal("war not fought")
+	}
+	w.Apply(gamelogic.Intent{Username: "carol", Kind: gamelogic.IntentMove, Location: "mars", UnitIDs: []int{1}})
+	w.SetPaused(true)
+	w.SetPaused(false)
+	apply(t, w, gamelogic.Intent{Username: "carol", Kind: gamelogic.IntentReset})
+	spawn("carol", "antarctica", gamelogic.RankCavalry)
+	apply(t, w, gamelogic.Intent{Username: "alice", Kind: gamelogic.IntentJoin})
+	w.SetPaused(true)
+	return w
+}
+
+func TestReplayWorldMatchesRecordedWorld(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	want := play(t, path).Snapshot()
+	var seen int
+	w, err := ReplayWorld(path, Until{}, func(Event) { seen++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := w.Snapshot()
+	got.SavedAt, want.SavedAt = time.Time{}, time.Time{}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed world\n%+v\nwant\n%+v", got, want)
+	}
+	if seen == 0 {
+		t.Error("no events replayed")
+	}
+
+	// Each player's own replay agrees with the world.
+	for _, p := range want.Players {
+		gs, err := Replay(path, p.Username, Until{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := gs.GetPlayerSnap(); !reflect.DeepEqual(got.Units, p.Units) {
+			t.Errorf("%s replayed %+v, want %+v", p.Username, got.Units, p.Units)
+		}
+	}
+
+	// Reopening carries on the numbering.
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := l.Append(Event{Kind: KindPause})
+	l.Close()
+	if err != nil || e.Seq != uint64(seen+1) {
+		t.Errorf("appended #%d, %v; want #%d", e.Seq, err, seen+1)
+	}
+}
+
+func TestReplayWorldUntil(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	play(t, path)
+	w, err := ReplayWorld(path, Until{Seq: 3}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bob, ok := w.Player("bob"); !ok || len(bob.Units) != 1 {
+		t.Errorf("after 3 events bob has %+v, want the one unit spawned", bob)
+	}
+	if _, ok := w.Player("carol"); ok {
+		t.Error("carol joined before event 4")
+	}
+}
+
+func TestReadDamagedLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	play(t, path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(strings.TrimSuffix(string(data), "\n"), "\n")
+
+	tests := []struct {
+		name string
+		log  string
+		want error
+	}{
+		{"truncated last line", strings.Join(lines[:len(lines)-1], "") + lines[len(lines)-1][:10], ErrTruncated},
+		{"missing newline", strings.Join(lines, ""), ErrTruncated},
+		{"gap", strings.Join(lines[:2], "") + strings.Join(lines[3:], "") + "\n", ErrGap},
+		{"out of order", lines[1] + lines[0] + strings.Join(lines[2:], "") + "\n", ErrGap},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			damaged := filepath.Join(t.TempDir(), "events.jsonl")
+			if err := os.WriteFile(damaged, []byte(tt.log), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ReplayWorld(damaged, Until{}, nil); !errors.Is(err, tt.want) {
+				t.Errorf("replay: got %v, want %v", err, tt.want)
+			}
+			if _, err := Open(damaged); !errors.Is(err, tt.want) {
+				t.Errorf("open: got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
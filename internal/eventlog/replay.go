@@ -0,0 +1,82 @@
+package eventlog
+
+import (
+	"errors"
+	"time"
+
+	"github.com/tdabry/learn-pub-sub-starter/internal/gamelogic"
+)
+
+// Until limits a replay. Zero fields do not limit it.
+type Until struct {
+	Seq  uint64
+	Time time.Time
+}
+
+func (u Until) stops(e Event) bool {
+	return u.Seq != 0 && e.Seq > u.Seq || !u.Time.IsZero() && e.Time.After(u.Time)
+}
+
+var errStop = errors.New("eventlog: replay stopped")
+
+// Replay rebuilds username's GameState from the log at path by feeding
+// each event up to until through the same gamelogic handlers the client
+// uses. seen is called with every event that was applied, if not nil.
+func Replay(path, username string, until Until, seen func(Event)) (*gamelogic.GameState, error) {
+	gs := gamelogic.NewGameState(username)
+	err := Read(path, func(e Event) error {
+		if until.stops(e) {
+			return errStop
+		}
+		Apply(gs, e)
+		if seen != nil {
+			seen(e)
+		}
+		return nil
+	})
+	if err == errStop {
+		err = nil
+	}
+	return gs, err
+}
+
+// ReplayWorld rebuilds the server's whole world from the log at path, up to
+// until. seen is called with every event that was applied, if not nil.
+func ReplayWorld(path string, until Until, seen func(Event)) (*gamelogic.World, error) {
+	w := gamelogic.NewWorld(nil)
+	err := Read(path, func(e Event) error {
+		if until.stops(e) {
+			return errStop
+		}
+		switch {
+		case e.State != nil:
+			w.ApplyDelta(*e.State)
+		case e.WarResolved != nil:
+			w.ApplyWar(*e.WarResolved)
+		case e.Pause != nil:
+			w.SetPaused(e.Pause.IsPaused)
+		}
+		if seen != nil {
+			seen(e)
+		}
+		return nil
+	})
+	if err == errStop {
+		err = nil
+	}
+	return w, err
+}
+
+// Apply feeds one event to gs.
+func Apply(gs *gamelogic.GameState, e Event) {
+	switch {
+	case e.State != nil:
+		gs.ApplyDelta(*e.State)
+	case e.Move != nil:
+		gs.HandleMove(*e.Move)
+	case e.WarResolved != nil:
+		gs.ApplyWar(*e.WarResolved)
+	case e.Pause != nil:
+		gs.HandlePause(*e.Pause)
+	}
+}
@@ -28,6 +28,9 @@ type ArmyMove struct {
 type RecognitionOfWar struct {
 	Attacker Player
 	Defender Player
+	// Location is where the attacker moved to. Wars recognized before it
+	// was added leave it empty.
+	Location Location
 }
 
 type Location string
@@ -18,6 +18,8 @@ func PrintClientHelp() {
 	fmt.Println("    example:")
 	fmt.Println("    spawn europe infantry")
 	fmt.Println("* status")
+	fmt.Println("* save")
+	fmt.Println("* reset")
 	fmt.Println("* spam <n>")
 	fmt.Println("    example:")
 	fmt.Println("    spam 5")
@@ -33,22 +35,35 @@ func ClientWelcome() (string, error) {
 		return "", errors.New("you must enter a username. goodbye")
 	}
 	username := words[0]
+	Welcome(username)
+	return username, nil
+}
+
+// Welcome greets a player whose name is already known.
+func Welcome(username string) {
 	fmt.Printf("Welcome, %s!\n", username)
 	PrintClientHelp()
-	return username, nil
 }
 
 func PrintServerHelp() {
 	fmt.Println("Possible commands:")
 	fmt.Println("* pause")
 	fmt.Println("* resume")
+	fmt.Println("* save")
+	fmt.Println("* logs [-user u] [-since t] [-until t] [-f] [-json] [text...]")
+	fmt.Println("* offenders")
 	fmt.Println("* quit")
 	fmt.Println("* help")
 }
 
+// stdin is shared by every GetInput call: a scanner per call would drop
+// whatever it had buffered past the first line, which loses commands piped
+// in faster than they are read.
+var stdin = bufio.NewScanner(os.Stdin)
+
 func GetInput() []string {
 	fmt.Print("> ")
-	scanner := bufio.NewScanner(os.Stdin)
+	scanner := stdin
 	scanned := scanner.Scan()
 	if !scanned {
 		return nil
@@ -39,42 +39,10 @@ func (gs *GameState) isPaused() bool {
 	return gs.Paused
 }
 
-func (gs *GameState) addUnit(u Unit) {
-	gs.mu.Lock()
-	defer gs.mu.Unlock()
-	gs.Player.Units[u.ID] = u
-}
-
-func (gs *GameState) removeUnitsInLocation(loc Location) {
-	gs.mu.Lock()
-	defer gs.mu.Unlock()
-	for k, v := range gs.Player.Units {
-		if v.Location == loc {
-			delete(gs.Player.Units, k)
-		}
-	}
-}
-
-func (gs *GameState) UpdateUnit(u Unit) {
-	gs.mu.Lock()
-	defer gs.mu.Unlock()
-	gs.Player.Units[u.ID] = u
-}
-
 func (gs *GameState) GetUsername() string {
 	return gs.Player.Username
 }
 
-func (gs *GameState) getUnitsSnap() []Unit {
-	gs.mu.RLock()
-	defer gs.mu.RUnlock()
-	Units := []Unit{}
-	for _, v := range gs.Player.Units {
-		Units = append(Units, v)
-	}
-	return Units
-}
-
 func (gs *GameState) GetUnit(id int) (Unit, bool) {
 	gs.mu.RLock()
 	defer gs.mu.RUnlock()
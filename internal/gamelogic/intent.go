@@ -0,0 +1,125 @@
+package gamelogic
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+type IntentKind string
+
+const (
+	// IntentJoin asks the server for the player's current units.
+	IntentJoin  IntentKind = "join"
+	IntentSpawn IntentKind = "spawn"
+	IntentMove  IntentKind = "move"
+	// IntentResume asks for the army the server last saved for the
+	// player. It is only taken if the server has no units for the player;
+	// otherwise it acts as a join.
+	IntentResume IntentKind = "resume"
+	// IntentReset gives up the player's army and starts over.
+	IntentReset IntentKind = "reset"
+)
+
+// Intent is what a client asks the server to do. The server decides
+// whether it is legal and answers with a StateDelta.
+type Intent struct {
+	Username string
+	Kind     IntentKind
+	Location Location
+	Rank     UnitRank
+	UnitIDs  []int
+}
+
+// StateDelta is the server's answer to an Intent: how the player's units
+// changed, or why nothing did.
+type StateDelta struct {
+	Username string
+	Kind     IntentKind
+	// Snapshot means Units is every unit the player has, not just the
+	// ones that changed.
+	Snapshot bool
+	Units    []Unit
+	Removed  []int
+	Rejected string
+}
+
+func (gs *GameState) CommandSpawnIntent(words []string) (Intent, error) {
+	if len(words) < 3 {
+		return Intent{}, errors.New("usage: spawn <location> <rank>")
+	}
+	in := Intent{
+		Username: gs.GetUsername(),
+		Kind:     IntentSpawn,
+		Location: Location(words[1]),
+		Rank:     UnitRank(words[2]),
+	}
+	return in, validSpawn(in)
+}
+
+func (gs *GameState) CommandMoveIntent(words []string) (Intent, error) {
+	if gs.isPaused() {
+		return Intent{}, errors.New("the game is paused, you can not move units")
+	}
+	if len(words) < 3 {
+		return Intent{}, errors.New("usage: move <location> <unitID> <unitID> <unitID> etc")
+	}
+	in := Intent{Username: gs.GetUsername(), Kind: IntentMove, Location: Location(words[1])}
+	if _, ok := getAllLocations()[in.Location]; !ok {
+		return Intent{}, fmt.Errorf("error: %s is not a valid location", in.Location)
+	}
+	for _, word := range words[2:] {
+		unitID, err := strconv.Atoi(word)
+		if err != nil {
+			return Intent{}, fmt.Errorf("error: %s is not a valid unit ID", word)
+		}
+		if _, ok := gs.GetUnit(unitID); !ok {
+			return Intent{}, fmt.Errorf("error: unit with ID %v not found", unitID)
+		}
+		in.UnitIDs = append(in.UnitIDs, unitID)
+	}
+	return in, nil
+}
+
+func validSpawn(in Intent) error {
+	if _, ok := getAllLocations()[in.Location]; !ok {
+		return fmt.Errorf("error: %s is not a valid location", in.Location)
+	}
+	if _, ok := getAllRanks()[in.Rank]; !ok {
+		return fmt.Errorf("error: %s is not a valid unit", in.Rank)
+	}
+	return nil
+}
+
+// ApplyDelta brings the local view in line with the server. Deltas for
+// other players are ignored.
+func (gs *GameState) ApplyDelta(d StateDelta) {
+	if d.Username != gs.GetUsername() {
+		return
+	}
+	if d.Rejected != "" {
+		fmt.Printf("The server refused your %s: %s\n", d.Kind, d.Rejected)
+		return
+	}
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if d.Snapshot {
+		gs.Player.Units = map[int]Unit{}
+	}
+	for _, u := range d.Units {
+		gs.Player.Units[u.ID] = u
+	}
+	for _, id := range d.Removed {
+		delete(gs.Player.Units, id)
+	}
+	switch {
+	case d.Snapshot:
+		fmt.Printf("You have %d unit(s).\n", len(gs.Player.Units))
+	case d.Kind == IntentSpawn:
+		for _, u := range d.Units {
+			fmt.Printf("Spawned a(n) %s in %s with id %v\n", u.Rank, u.Location, u.ID)
+		}
+	case d.Kind == IntentMove && len(d.Units) > 0:
+		fmt.Printf("Moved %v units to %s\n", len(d.Units), d.Units[0].Location)
+	}
+}
@@ -0,0 +1,113 @@
+package gamelogic
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// GameSnapshot is a client's saved view of its own army.
+type GameSnapshot struct {
+	SavedAt time.Time
+	Player  Player
+	Paused  bool
+}
+
+// WorldSnapshot is the server's saved world.
+type WorldSnapshot struct {
+	SavedAt time.Time
+	Players []Player
+	NextID  map[string]int
+	Paused  bool
+}
+
+func (gs *GameState) Snapshot() GameSnapshot {
+	return GameSnapshot{SavedAt: time.Now(), Player: gs.GetPlayerSnap(), Paused: gs.isPaused()}
+}
+
+func (w *World) Snapshot() WorldSnapshot {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := WorldSnapshot{SavedAt: time.Now(), NextID: map[string]int{}, Paused: w.paused}
+	for _, name := range w.usernamesLocked() {
+		s.Players = append(s.Players, copyPlayer(w.players[name]))
+		s.NextID[name] = w.nextID[name]
+	}
+	return s
+}
+
+// Restore replaces the whole world with s, which players can then resume
+// their armies from.
+func (w *World) Restore(s WorldSnapshot) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.players = map[string]*Player{}
+	w.nextID = map[string]int{}
+	w.paused = s.Paused
+	for _, p := range s.Players {
+		p := copyPlayer(&p)
+		w.players[p.Username] = &p
+		w.nextID[p.Username] = max(s.NextID[p.Username], maxUnitID(p.Units))
+	}
+	w.savedLocked(s)
+}
+
+// Saved records that s was written to disk, so players resume from it.
+func (w *World) Saved(s WorldSnapshot) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.savedLocked(s)
+}
+
+func (w *World) savedLocked(s WorldSnapshot) {
+	w.saved = map[string]Player{}
+	for _, p := range s.Players {
+		w.saved[p.Username] = copyPlayer(&p)
+	}
+}
+
+func maxUnitID(units map[int]Unit) int {
+	n := 0
+	for id := range units {
+		n = max(n, id)
+	}
+	return n
+}
+
+// SaveSnapshot writes v to path as JSON. It writes to a temporary file
+// first, so a crash mid-save leaves the previous snapshot intact.
+func SaveSnapshot(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadSnapshot reads a snapshot written by SaveSnapshot into v. A missing
+// file is reported with an error that satisfies os.IsNotExist.
+func LoadSnapshot(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
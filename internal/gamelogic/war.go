@@ -8,98 +8,135 @@ type WarOutcome int
 
 const (
 	WarOutcomeNotInvolved WarOutcome = iota
-	WarOutcomeNoUnits
 	WarOutcomeYouWon
 	WarOutcomeOpponentWon
 	WarOutcomeDraw
 )
 
-func (gs *GameState) HandleWar(rw RecognitionOfWar) (outcome WarOutcome, winner string, loser string) {
-	defer fmt.Println("------------------------")
-	fmt.Println()
-	fmt.Println("==== War Declared ====")
-	fmt.Printf("%s has declared war on %s!\n", rw.Attacker.Username, rw.Defender.Username)
+func unitsToPowerLevel(units []Unit) int {
+	power := 0
+	for _, unit := range units {
+		if unit.Rank == RankArtillery {
+			power += 10
+		}
+		if unit.Rank == RankCavalry {
+			power += 5
+		}
+		if unit.Rank == RankInfantry {
+			power += 1
+		}
+	}
+	return power
+}
 
-	player := gs.GetPlayerSnap()
+// WarResolved is the server's verdict on a war. Casualties lists the IDs
+// of the units each player lost; Winner is empty for a draw.
+type WarResolved struct {
+	Attacker   string
+	Defender   string
+	Location   Location
+	Winner     string
+	Loser      string
+	Casualties map[string][]int
+}
 
-	if player.Username == rw.Defender.Username {
-		fmt.Printf("%s, you published the war.\n", player.Username)
-		return WarOutcomeNotInvolved, "", ""
+// ResolveWar fights rw with the units the world has now, not the ones the
+// recognition carries, and removes the casualties. The war is fought where
+// the attacker moved to, or for recognitions without a location, at the
+// first location the two share. It reports false if they no longer both
+// have units there.
+func (w *World) ResolveWar(rw RecognitionOfWar) (WarResolved, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	wr, ok := w.resolveWarLocked(rw)
+	if ok {
+		w.rec.Resolved(wr)
 	}
+	return wr, ok
+}
 
-	if player.Username != rw.Attacker.Username {
-		fmt.Printf("%s, you are not involved in this war.\n", player.Username)
-		return WarOutcomeNotInvolved, "", ""
+func (w *World) resolveWarLocked(rw RecognitionOfWar) (WarResolved, bool) {
+	attacker, ok := w.players[rw.Attacker.Username]
+	if !ok {
+		return WarResolved{}, false
 	}
-
-	overlappingLocation := getOverlappingLocation(rw.Attacker, rw.Defender)
-	if overlappingLocation == "" {
-		fmt.Printf("Error! No units are in the same location. No war will be fought.\n")
-		return WarOutcomeNoUnits, "", ""
+	defender, ok := w.players[rw.Defender.Username]
+	if !ok || attacker == defender {
+		return WarResolved{}, false
 	}
-
-	attackerUnits := []Unit{}
-	defenderUnits := []Unit{}
-	for _, unit := range rw.Attacker.Units {
-		if unit.Location == overlappingLocation {
-			attackerUnits = append(attackerUnits, unit)
-		}
+	loc := rw.Location
+	if loc == "" {
+		loc = getOverlappingLocation(*attacker, *defender)
 	}
-	for _, unit := range rw.Defender.Units {
-		if unit.Location == overlappingLocation {
-			defenderUnits = append(defenderUnits, unit)
-		}
+	if loc == "" || len(unitsIn(attacker, loc)) == 0 || len(unitsIn(defender, loc)) == 0 {
+		return WarResolved{}, false
 	}
-
-	fmt.Printf("%s's units:\n", rw.Attacker.Username)
-	for _, unit := range attackerUnits {
-		fmt.Printf("  * %v\n", unit.Rank)
+	wr := WarResolved{
+		Attacker:   attacker.Username,
+		Defender:   defender.Username,
+		Location:   loc,
+		Casualties: map[string][]int{},
 	}
-	fmt.Printf("%s's units:\n", rw.Defender.Username)
-	for _, unit := range defenderUnits {
-		fmt.Printf("  * %v\n", unit.Rank)
+	attackerPower := unitsToPowerLevel(unitsIn(attacker, loc))
+	defenderPower := unitsToPowerLevel(unitsIn(defender, loc))
+	var losers []*Player
+	switch {
+	case attackerPower > defenderPower:
+		wr.Winner, wr.Loser = attacker.Username, defender.Username
+		losers = []*Player{defender}
+	case defenderPower > attackerPower:
+		wr.Winner, wr.Loser = defender.Username, attacker.Username
+		losers = []*Player{attacker}
+	default:
+		losers = []*Player{attacker, defender}
 	}
-	attackerPower := unitsToPowerLevel(attackerUnits)
-	defenderPower := unitsToPowerLevel(defenderUnits)
-	fmt.Printf("Attacker has a power level of %v\n", attackerPower)
-	fmt.Printf("Defender has a power level of %v\n", defenderPower)
-	if attackerPower > defenderPower {
-		fmt.Printf("%s has won the war!\n", rw.Attacker.Username)
-		if player.Username == rw.Defender.Username {
-			fmt.Println("You have lost the war!")
-			gs.removeUnitsInLocation(overlappingLocation)
-			fmt.Printf("Your units in %s have been killed.\n", overlappingLocation)
-			return WarOutcomeOpponentWon, rw.Attacker.Username, rw.Defender.Username
-		}
-		return WarOutcomeYouWon, rw.Attacker.Username, rw.Defender.Username
-	} else if defenderPower > attackerPower {
-		fmt.Printf("%s has won the war!\n", rw.Defender.Username)
-		if player.Username == rw.Attacker.Username {
-			fmt.Println("You have lost the war!")
-			gs.removeUnitsInLocation(overlappingLocation)
-			fmt.Printf("Your units in %s have been killed.\n", overlappingLocation)
-			return WarOutcomeOpponentWon, rw.Defender.Username, rw.Attacker.Username
+	for _, p := range losers {
+		for _, u := range unitsIn(p, loc) {
+			wr.Casualties[p.Username] = append(wr.Casualties[p.Username], u.ID)
+			delete(p.Units, u.ID)
 		}
-		return WarOutcomeYouWon, rw.Defender.Username, rw.Attacker.Username
 	}
-	fmt.Println("The war ended in a draw!")
-	fmt.Printf("Your units in %s have been killed.\n", overlappingLocation)
-	gs.removeUnitsInLocation(overlappingLocation)
-	return WarOutcomeDraw, rw.Attacker.Username, rw.Defender.Username
+	return wr, true
 }
 
-func unitsToPowerLevel(units []Unit) int {
-	power := 0
-	for _, unit := range units {
-		if unit.Rank == RankArtillery {
-			power += 10
-		}
-		if unit.Rank == RankCavalry {
-			power += 5
+func unitsIn(p *Player, loc Location) []Unit {
+	units := []Unit{}
+	for _, u := range sortedUnits(p.Units) {
+		if u.Location == loc {
+			units = append(units, u)
 		}
-		if unit.Rank == RankInfantry {
-			power += 1
+	}
+	return units
+}
+
+// ApplyWar reports a resolved war and removes the player's casualties.
+func (gs *GameState) ApplyWar(wr WarResolved) WarOutcome {
+	defer fmt.Println("------------------------")
+	fmt.Println()
+	fmt.Println("==== War Resolved ====")
+	fmt.Printf("%s declared war on %s in %s.\n", wr.Attacker, wr.Defender, wr.Location)
+	if wr.Winner == "" {
+		fmt.Println("The war ended in a draw!")
+	} else {
+		fmt.Printf("%s has won the war!\n", wr.Winner)
+	}
+	username := gs.GetUsername()
+	if username != wr.Attacker && username != wr.Defender {
+		return WarOutcomeNotInvolved
+	}
+	if lost := wr.Casualties[username]; len(lost) > 0 {
+		gs.mu.Lock()
+		for _, id := range lost {
+			delete(gs.Player.Units, id)
 		}
+		gs.mu.Unlock()
+		fmt.Printf("Your units in %s have been killed.\n", wr.Location)
 	}
-	return power
+	switch wr.Winner {
+	case "":
+		return WarOutcomeDraw
+	case username:
+		return WarOutcomeYouWon
+	}
+	return WarOutcomeOpponentWon
 }
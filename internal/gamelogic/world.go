@@ -0,0 +1,243 @@
+package gamelogic
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// World is the server's canonical state: every player's units and
+// whether the game is paused. Clients only ever see it through the
+// StateDeltas it returns.
+type World struct {
+	mu      sync.Mutex
+	rec     Recorder
+	players map[string]*Player
+	nextID  map[string]int
+	paused  bool
+	// saved is every player's army as of the last snapshot written to or
+	// read from disk. IntentResume restores from it.
+	saved map[string]Player
+}
+
+// Recorder is told about every change the world decides on. Its methods
+// run with the world locked, so they see changes in the order they were
+// made, and must not call back into the world.
+type Recorder interface {
+	Applied(in Intent, out Outcome)
+	Resolved(wr WarResolved)
+	Paused(paused bool)
+}
+
+// NewWorld returns an empty world that reports to rec, which may be nil.
+func NewWorld(rec Recorder) *World {
+	if rec == nil {
+		rec = nopRecorder{}
+	}
+	return &World{rec: rec, players: map[string]*Player{}, nextID: map[string]int{}, saved: map[string]Player{}}
+}
+
+type nopRecorder struct{}
+
+func (nopRecorder) Applied(Intent, Outcome) {}
+func (nopRecorder) Resolved(WarResolved)    {}
+func (nopRecorder) Paused(bool)             {}
+
+// Outcome is what applying an Intent did to the world.
+type Outcome struct {
+	Delta StateDelta
+	// Move is set for an accepted move, with the mover's units after it.
+	Move *ArmyMove
+	// Wars lists the wars the move started, one per player it ran into.
+	Wars []RecognitionOfWar
+}
+
+func (w *World) SetPaused(paused bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.paused = paused
+	w.rec.Paused(paused)
+}
+
+// Apply validates in against the world and applies it if it is legal. A
+// refused intent comes back as a delta with Rejected set.
+func (w *World) Apply(in Intent) Outcome {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	out := w.applyLocked(in)
+	w.rec.Applied(in, out)
+	return out
+}
+
+func (w *World) applyLocked(in Intent) Outcome {
+	if in.Username == "" {
+		return rejected(in, errors.New("no username"))
+	}
+	p := w.playerLocked(in.Username)
+	switch in.Kind {
+	case IntentJoin:
+		return Outcome{Delta: StateDelta{Username: p.Username, Kind: in.Kind,
+			Snapshot: true, Units: sortedUnits(p.Units)}}
+	case IntentSpawn:
+		if err := validSpawn(in); err != nil {
+			return rejected(in, err)
+		}
+		w.nextID[p.Username]++
+		u := Unit{ID: w.nextID[p.Username], Rank: in.Rank, Location: in.Location}
+		p.Units[u.ID] = u
+		return Outcome{Delta: StateDelta{Username: p.Username, Kind: in.Kind, Units: []Unit{u}}}
+	case IntentMove:
+		return w.moveLocked(p, in)
+	case IntentResume:
+		if len(p.Units) == 0 {
+			if err := w.resumeLocked(p); err != nil {
+				return rejected(in, err)
+			}
+		}
+		return Outcome{Delta: StateDelta{Username: p.Username, Kind: in.Kind,
+			Snapshot: true, Units: sortedUnits(p.Units)}}
+	case IntentReset:
+		p.Units = map[int]Unit{}
+		return Outcome{Delta: StateDelta{Username: p.Username, Kind: in.Kind, Snapshot: true}}
+	}
+	return rejected(in, fmt.Errorf("unknown intent %q", in.Kind))
+}
+
+func (w *World) moveLocked(p *Player, in Intent) Outcome {
+	if w.paused {
+		return rejected(in, errors.New("the game is paused"))
+	}
+	if _, ok := getAllLocations()[in.Location]; !ok {
+		return rejected(in, fmt.Errorf("%s is not a valid location", in.Location))
+	}
+	if len(in.UnitIDs) == 0 {
+		return rejected(in, errors.New("no units to move"))
+	}
+	moved := []Unit{}
+	seen := map[int]bool{}
+	for _, id := range in.UnitIDs {
+		u, ok := p.Units[id]
+		if !ok {
+			return rejected(in, fmt.Errorf("you have no unit with ID %v", id))
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		u.Location = in.Location
+		moved = append(moved, u)
+	}
+	for _, u := range moved {
+		p.Units[u.ID] = u
+	}
+	mover := copyPlayer(p)
+	out := Outcome{
+		Delta: StateDelta{Username: p.Username, Kind: in.Kind, Units: moved},
+		Move:  &ArmyMove{Player: mover, Units: moved, ToLocation: in.Location},
+	}
+	for _, name := range w.usernamesLocked() {
+		other := w.players[name]
+		if name == p.Username || len(unitsIn(other, in.Location)) == 0 {
+			continue
+		}
+		out.Wars = append(out.Wars, RecognitionOfWar{Attacker: mover, Defender: copyPlayer(other), Location: in.Location})
+	}
+	return out
+}
+
+// resumeLocked gives p back the army the server last saved for it.
+func (w *World) resumeLocked(p *Player) error {
+	saved, ok := w.saved[p.Username]
+	if !ok || len(saved.Units) == 0 {
+		return errors.New("the server has no saved army for you")
+	}
+	p.Units = copyPlayer(&saved).Units
+	w.nextID[p.Username] = max(w.nextID[p.Username], maxUnitID(p.Units))
+	return nil
+}
+
+// ApplyDelta replays a delta the world decided on before, such as one read
+// back from an event log. It is not validated again and the recorder is
+// not told about it.
+func (w *World) ApplyDelta(d StateDelta) {
+	if d.Rejected != "" {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	p := w.playerLocked(d.Username)
+	if d.Snapshot {
+		p.Units = map[int]Unit{}
+	}
+	for _, u := range d.Units {
+		p.Units[u.ID] = u
+		w.nextID[p.Username] = max(w.nextID[p.Username], u.ID)
+	}
+	for _, id := range d.Removed {
+		delete(p.Units, id)
+	}
+}
+
+// ApplyWar replays a war the world resolved before, removing its
+// casualties.
+func (w *World) ApplyWar(wr WarResolved) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for name, ids := range wr.Casualties {
+		p := w.playerLocked(name)
+		for _, id := range ids {
+			delete(p.Units, id)
+		}
+	}
+}
+
+// Player returns a copy of username's state.
+func (w *World) Player(username string) (Player, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	p, ok := w.players[username]
+	if !ok {
+		return Player{}, false
+	}
+	return copyPlayer(p), true
+}
+
+func (w *World) playerLocked(username string) *Player {
+	p, ok := w.players[username]
+	if !ok {
+		p = &Player{Username: username, Units: map[int]Unit{}}
+		w.players[username] = p
+	}
+	return p
+}
+
+func (w *World) usernamesLocked() []string {
+	names := make([]string, 0, len(w.players))
+	for name := range w.players {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func rejected(in Intent, err error) Outcome {
+	return Outcome{Delta: StateDelta{Username: in.Username, Kind: in.Kind, Rejected: err.Error()}}
+}
+
+func copyPlayer(p *Player) Player {
+	units := make(map[int]Unit, len(p.Units))
+	for id, u := range p.Units {
+		units[id] = u
+	}
+	return Player{Username: p.Username, Units: units}
+}
+
+func sortedUnits(units map[int]Unit) []Unit {
+	out := make([]Unit, 0, len(units))
+	for _, u := range units {
+		out = append(out, u)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
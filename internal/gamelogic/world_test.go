@@ -0,0 +1,150 @@
+package gamelogic
+
+import (
+	"strings"
+	"testing"
+)
+
+func mustApply(t *testing.T, w *World, in Intent) Outcome {
+	t.Helper()
+	out := w.Apply(in)
+	if out.Delta.Rejected != "" {
+		t.Fatalf("%s refused: %s", in.Kind, out.Delta.Rejected)
+	}
+	return out
+}
+
+func spawn(t *testing.T, w *World, user string, loc Location, rank UnitRank) Unit {
+	t.Helper()
+	out := mustApply(t, w, Intent{Username: user, Kind: IntentSpawn, Location: loc, Rank: rank})
+	return out.Delta.Units[0]
+}
+
+func TestWarIsFoughtAtTheMoveDestination(t *testing.T) {
+	for range 20 {
+		w := NewWorld(nil)
+		spawn(t, w, "alice", "africa", RankArtillery)
+		spawn(t, w, "alice", "europe", RankInfantry)
+		spawn(t, w, "bob", "africa", RankInfantry)
+		mover := spawn(t, w, "bob", "asia", RankArtillery)
+
+		// bob already shares africa with alice; moving into europe starts
+		// a war there, not in africa.
+		out := mustApply(t, w, Intent{Username: "bob", Kind: IntentMove, Location: "europe", UnitIDs: []int{mover.ID}})
+		if len(out.Wars) != 1 || out.Wars[0].Location != "europe" {
+			t.Fatalf("wars %+v, want one in europe", out.Wars)
+		}
+		wr, ok := w.ResolveWar(out.Wars[0])
+		if !ok || wr.Location != "europe" || wr.Winner != "bob" {
+			t.Fatalf("resolved %+v, %v; want bob winning in europe", wr, ok)
+		}
+		if alice, _ := w.Player("alice"); len(unitsIn(&alice, "africa")) != 1 {
+			t.Errorf("alice lost units outside europe: %+v", alice.Units)
+		}
+	}
+}
+
+func TestMoveAwayFromOverlapStartsNoWar(t *testing.T) {
+	w := NewWorld(nil)
+	spawn(t, w, "alice", "africa", RankInfantry)
+	spawn(t, w, "bob", "africa", RankInfantry)
+	mover := spawn(t, w, "bob", "asia", RankInfantry)
+	out := mustApply(t, w, Intent{Username: "bob", Kind: IntentMove, Location: "europe", UnitIDs: []int{mover.ID}})
+	if len(out.Wars) != 0 {
+		t.Errorf("move to an empty location started %+v", out.Wars)
+	}
+}
+
+func TestResolveWarWithoutLocationIsDeterministic(t *testing.T) {
+	w := NewWorld(nil)
+	for _, loc := range []Location{"europe", "africa", "asia"} {
+		spawn(t, w, "alice", loc, RankInfantry)
+		spawn(t, w, "bob", loc, RankInfantry)
+	}
+	alice, _ := w.Player("alice")
+	bob, _ := w.Player("bob")
+	wr, ok := w.ResolveWar(RecognitionOfWar{Attacker: bob, Defender: alice})
+	if !ok || wr.Location != "africa" {
+		t.Errorf("resolved %+v, %v; want the war in africa, the first shared location", wr, ok)
+	}
+}
+
+func TestResolveWarCalledOffWhenNoLongerThere(t *testing.T) {
+	w := NewWorld(nil)
+	a := spawn(t, w, "alice", "europe", RankInfantry)
+	b := spawn(t, w, "bob", "asia", RankInfantry)
+	out := mustApply(t, w, Intent{Username: "bob", Kind: IntentMove, Location: "europe", UnitIDs: []int{b.ID}})
+	mustApply(t, w, Intent{Username: "alice", Kind: IntentMove, Location: "africa", UnitIDs: []int{a.ID}})
+	if wr, ok := w.ResolveWar(out.Wars[0]); ok {
+		t.Errorf("war fought after alice left: %+v", wr)
+	}
+}
+
+func TestResumeFromServerSave(t *testing.T) {
+	w := NewWorld(nil)
+	saved := spawn(t, w, "bob", "asia", RankCavalry)
+	w.Saved(w.Snapshot())
+	spawn(t, w, "bob", "europe", RankInfantry)
+
+	// bob still has units, so resuming only reports them.
+	out := mustApply(t, w, Intent{Username: "bob", Kind: IntentResume})
+	if len(out.Delta.Units) != 2 || !out.Delta.Snapshot {
+		t.Fatalf("resume with units: %+v", out.Delta)
+	}
+
+	mustApply(t, w, Intent{Username: "bob", Kind: IntentReset})
+	out = mustApply(t, w, Intent{Username: "bob", Kind: IntentResume})
+	if len(out.Delta.Units) != 1 || out.Delta.Units[0] != saved {
+		t.Fatalf("resumed %+v, want the saved %+v", out.Delta.Units, saved)
+	}
+	// Units spawned after the save keep their IDs retired.
+	if u := spawn(t, w, "bob", "asia", RankInfantry); u.ID != 3 {
+		t.Errorf("spawned unit %d after resume, want 3", u.ID)
+	}
+
+	if out := w.Apply(Intent{Username: "alice", Kind: IntentResume}); out.Delta.Rejected == "" {
+		t.Errorf("alice resumed an army that was never saved: %+v", out.Delta)
+	}
+}
+
+// lockedRecorder checks that the world is locked while it records.
+type lockedRecorder struct {
+	t      *testing.T
+	w      *World
+	events []string
+}
+
+func (r *lockedRecorder) add(event string) {
+	if r.w.mu.TryLock() {
+		r.w.mu.Unlock()
+		r.t.Errorf("%s recorded with the world unlocked", event)
+	}
+	r.events = append(r.events, event)
+}
+
+func (r *lockedRecorder) Applied(in Intent, out Outcome) {
+	r.add(string(in.Kind))
+	for range out.Wars {
+		r.add("war")
+	}
+}
+func (r *lockedRecorder) Resolved(WarResolved) { r.add("resolved") }
+func (r *lockedRecorder) Paused(bool)          { r.add("pause") }
+
+func TestRecorderSeesChangesInOrder(t *testing.T) {
+	rec := &lockedRecorder{t: t}
+	w := NewWorld(rec)
+	rec.w = w
+	spawn(t, w, "alice", "europe", RankInfantry)
+	b := spawn(t, w, "bob", "asia", RankArtillery)
+	out := mustApply(t, w, Intent{Username: "bob", Kind: IntentMove, Location: "europe", UnitIDs: []int{b.ID}})
+	w.ResolveWar(out.Wars[0])
+	w.ResolveWar(out.Wars[0]) // alice's units are gone: nothing to record
+	w.SetPaused(true)
+	w.Apply(Intent{Username: "bob", Kind: IntentMove, Location: "asia", UnitIDs: []int{b.ID}})
+
+	want := "spawn spawn move war resolved pause move"
+	if got := strings.Join(rec.events, " "); got != want {
+		t.Errorf("recorded %q, want %q", got, want)
+	}
+}
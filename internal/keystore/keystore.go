@@ -0,0 +1,192 @@
+// Package keystore keeps the public keys players sign their messages
+// with, and the private keys processes sign with themselves.
+package keystore
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/tdabry/learn-pub-sub-starter/internal/pubsub"
+)
+
+var ErrKeyMismatch = errors.New("a different key is already registered")
+
+// ServerName is the name the server signs its messages as. Players cannot
+// register it: the server sets its key at startup.
+const ServerName = "server"
+
+// Store maps names to public keys and saves them to a JSON file on every
+// change.
+type Store struct {
+	path string
+
+	mu   sync.RWMutex
+	keys map[string]ed25519.PublicKey
+}
+
+// Open loads the store at path, starting empty if the file does not exist.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, keys: make(map[string]ed25519.PublicKey)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.keys); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return s, nil
+}
+
+func (s *Store) PublicKey(name string) (ed25519.PublicKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	pub, ok := s.keys[name]
+	return pub, ok
+}
+
+// Register records pub for name. Registering the key name already has is a
+// no-op; a different one fails with ErrKeyMismatch.
+func (s *Store) Register(name string, pub ed25519.PublicKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.keys[name]; ok {
+		if !old.Equal(pub) {
+			return ErrKeyMismatch
+		}
+		return nil
+	}
+	s.keys[name] = pub
+	return s.saveLocked()
+}
+
+// Set records pub for name, replacing any key it had.
+func (s *Store) Set(name string, pub ed25519.PublicKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[name] = pub
+	return s.saveLocked()
+}
+
+// Revoke forgets name's key, so the next one it signs with is trusted.
+func (s *Store) Revoke(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, name)
+	return s.saveLocked()
+}
+
+func (s *Store) saveLocked() error {
+	data, err := json.MarshalIndent(s.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// TrustOnFirstUse registers the key a message offers if its signer has
+// none yet, owns the routing key the message was signed under and signed
+// it with that key. Put it before pubsub.Verify, with the same owner, on
+// the subscription new players first write to.
+func (s *Store) TrustOnFirstUse(owner pubsub.Owner) pubsub.Middleware {
+	return func(next pubsub.HandlerFunc) pubsub.HandlerFunc {
+		return func(ctx context.Context, md pubsub.Metadata) pubsub.Acktype {
+			signer, offered, err := md.Signature()
+			if err != nil || offered == nil {
+				return next(ctx, md)
+			}
+			if _, ok := s.PublicKey(signer); ok {
+				return next(ctx, md)
+			}
+			if name, ok := owner(md); !ok || name != signer {
+				return next(ctx, md)
+			}
+			if pubsub.CheckSignature(md, offered) == nil {
+				if err := s.Register(signer, offered); err != nil {
+					log.Printf("could not register key for %s: %v", signer, err)
+				} else {
+					log.Printf("registered key for %s", signer)
+				}
+			}
+			return next(ctx, md)
+		}
+	}
+}
+
+// LoadSigner reads name's private key from path, creating one if the file
+// does not exist yet.
+func LoadSigner(path, name string) (pubsub.Signer, error) {
+	seed, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		seed = make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			return pubsub.Signer{}, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return pubsub.Signer{}, err
+		}
+		if err := os.WriteFile(path, seed, 0o600); err != nil {
+			return pubsub.Signer{}, err
+		}
+	} else if err != nil {
+		return pubsub.Signer{}, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return pubsub.Signer{}, fmt.Errorf("%s: not an ed25519 seed", path)
+	}
+	return pubsub.Signer{Name: name, Key: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// WritePublicKey saves pub to path, base64 encoded, for clients to load
+// with LoadPublicKey.
+func WritePublicKey(path string, pub ed25519.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(pub)+"\n"), 0o644)
+}
+
+// LoadPublicKey reads a key saved by WritePublicKey.
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%s: not an ed25519 public key", path)
+	}
+	return pub, nil
+}
+
+// Map is a fixed set of public keys, such as the server's that a client
+// checks its messages against.
+type Map map[string]ed25519.PublicKey
+
+func (m Map) PublicKey(name string) (ed25519.PublicKey, bool) {
+	pub, ok := m[name]
+	return pub, ok
+}
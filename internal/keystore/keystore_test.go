@@ -0,0 +1,111 @@
+package keystore
+
+import (
+	"context"
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/tdabry/learn-pub-sub-starter/internal/pubsub"
+)
+
+// capture keeps the last message published through it.
+type capture struct{ msg amqp.Publishing }
+
+func (c *capture) PublishWithContext(_ context.Context, _, _ string, _, _ bool, msg amqp.Publishing) error {
+	c.msg = msg
+	return nil
+}
+
+// signedAs publishes a message signed by a fresh key for name under
+// intents.<owner> and returns it as a delivery would see it.
+func signedAs(t *testing.T, name, owner string) pubsub.Metadata {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c capture
+	pub := pubsub.Signed(&c, pubsub.Signer{Name: name, Key: key})
+	if err := pub.PublishWithContext(context.Background(), "ex", "intents."+owner, false, false,
+		amqp.Publishing{ContentType: pubsub.ContentTypeJSON, Body: []byte("{}")}); err != nil {
+		t.Fatal(err)
+	}
+	return pubsub.Metadata{
+		MessageID:   c.msg.MessageId,
+		ContentType: c.msg.ContentType,
+		Timestamp:   c.msg.Timestamp.Truncate(time.Second),
+		RoutingKey:  "intents." + owner,
+		Headers:     c.msg.Headers,
+		Raw:         c.msg.Body,
+	}
+}
+
+func intentOwner(md pubsub.Metadata) (string, bool) {
+	return strings.CutPrefix(md.SignedKey(), "intents.")
+}
+
+func TestTrustOnFirstUse(t *testing.T) {
+	tests := []struct {
+		name, signer, owner string
+		registered          bool
+	}{
+		{"own key", "bob", "bob", true},
+		{"someone else's key", "alice", "bob", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Open(filepath.Join(t.TempDir(), "keys.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := s.TrustOnFirstUse(intentOwner)(func(context.Context, pubsub.Metadata) pubsub.Acktype {
+				return pubsub.Ack
+			})
+			h(context.Background(), signedAs(t, tt.signer, tt.owner))
+			if _, ok := s.PublicKey(tt.signer); ok != tt.registered {
+				t.Errorf("registered %s: %v, want %v", tt.signer, ok, tt.registered)
+			}
+		})
+	}
+}
+
+func TestPublicKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	signer, err := LoadSigner(filepath.Join(dir, "server.key"), ServerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "pub", "server.pub")
+	want := signer.Key.Public().(ed25519.PublicKey)
+	if err := WritePublicKey(path, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadPublicKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(want) {
+		t.Errorf("loaded %x, want %x", got, want)
+	}
+	if pub, ok := (Map{ServerName: got}).PublicKey(ServerName); !ok || !pub.Equal(want) {
+		t.Error("key not found in a Map")
+	}
+
+	for name, data := range map[string]string{"empty": "", "not base64": "server\n", "short": "c2VydmVy\n"} {
+		bad := filepath.Join(dir, "bad.pub")
+		if err := os.WriteFile(bad, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadPublicKey(bad); err == nil {
+			t.Errorf("%s: loaded a key", name)
+		}
+	}
+	if _, err := LoadPublicKey(filepath.Join(dir, "missing.pub")); !os.IsNotExist(err) {
+		t.Errorf("missing file: %v", err)
+	}
+}
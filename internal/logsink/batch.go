@@ -0,0 +1,110 @@
+package logsink
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/tdabry/learn-pub-sub-starter/internal/routing"
+)
+
+var ErrClosed = errors.New("logsink: closed")
+
+// Batcher collects logs from concurrent callers and writes them to a Sink
+// in batches of up to Size, or whatever has arrived after Wait.
+type Batcher struct {
+	sink Sink
+	size int
+	wait time.Duration
+
+	pending chan batchEntry
+	done    chan struct{}
+	closing sync.Once
+	stopped chan struct{}
+}
+
+type batchEntry struct {
+	log    routing.GameLog
+	result chan error
+}
+
+func NewBatcher(sink Sink, size int, wait time.Duration) *Batcher {
+	if size < 1 {
+		size = 1
+	}
+	b := &Batcher{
+		sink:    sink,
+		size:    size,
+		wait:    wait,
+		pending: make(chan batchEntry),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// Add queues lg and waits for the batch it ends up in to be written, so a
+// nil error means the log is stored.
+func (b *Batcher) Add(ctx context.Context, lg routing.GameLog) error {
+	e := batchEntry{log: lg, result: make(chan error, 1)}
+	select {
+	case b.pending <- e:
+	case <-b.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-e.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close writes whatever is pending and closes the sink.
+func (b *Batcher) Close() error {
+	b.closing.Do(func() { close(b.done) })
+	<-b.stopped
+	return b.sink.Close()
+}
+
+func (b *Batcher) run() {
+	defer close(b.stopped)
+	for {
+		var batch []batchEntry
+		select {
+		case e := <-b.pending:
+			batch = append(batch, e)
+		case <-b.done:
+			return
+		}
+		timer := time.NewTimer(b.wait)
+	fill:
+		for len(batch) < b.size {
+			select {
+			case e := <-b.pending:
+				batch = append(batch, e)
+			case <-timer.C:
+				break fill
+			case <-b.done:
+				break fill
+			}
+		}
+		timer.Stop()
+		b.flush(batch)
+	}
+}
+
+func (b *Batcher) flush(batch []batchEntry) {
+	logs := make([]routing.GameLog, len(batch))
+	for i, e := range batch {
+		logs[i] = e.log
+	}
+	err := b.sink.Write(context.Background(), logs)
+	for _, e := range batch {
+		e.result <- err
+	}
+}
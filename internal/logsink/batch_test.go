@@ -0,0 +1,168 @@
+package logsink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tdabry/learn-pub-sub-starter/internal/routing"
+)
+
+// recorder is a Sink that keeps the batches written to it.
+type recorder struct {
+	mu       sync.Mutex
+	batches  [][]routing.GameLog
+	err      error
+	closed   bool
+	closeErr error
+}
+
+func (r *recorder) Write(ctx context.Context, logs []routing.GameLog) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batches = append(r.batches, append([]routing.GameLog(nil), logs...))
+	return r.err
+}
+
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return r.closeErr
+}
+
+func (r *recorder) sizes() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var sizes []int
+	for _, b := range r.batches {
+		sizes = append(sizes, len(b))
+	}
+	return sizes
+}
+
+func gameLog(user string, i int) routing.GameLog {
+	return routing.GameLog{
+		CurrentTime: time.Date(2024, 1, 2, 3, 4, i, 0, time.UTC),
+		Username:    user,
+		Message:     fmt.Sprint("message ", i),
+	}
+}
+
+// addAll adds n logs at once and returns their errors once all are back.
+func addAll(t *testing.T, b *Batcher, n int) []error {
+	t.Helper()
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = b.Add(context.Background(), gameLog("bob", i))
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Add did not return")
+	}
+	return errs
+}
+
+func TestBatcherFlushesWhenFull(t *testing.T) {
+	sink := &recorder{}
+	b := NewBatcher(sink, 3, time.Hour)
+	defer b.Close()
+	for i, err := range addAll(t, b, 6) {
+		if err != nil {
+			t.Errorf("add %d: %v", i, err)
+		}
+	}
+	if got := sink.sizes(); len(got) != 2 || got[0] != 3 || got[1] != 3 {
+		t.Errorf("wrote batches of %v, want two of 3", got)
+	}
+}
+
+func TestBatcherFlushesAfterWait(t *testing.T) {
+	sink := &recorder{}
+	b := NewBatcher(sink, 10, 20*time.Millisecond)
+	defer b.Close()
+	start := time.Now()
+	if err := addAll(t, b, 2); err[0] != nil || err[1] != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("flushed after %v, before the wait was up", waited)
+	}
+	if got := sink.sizes(); len(got) == 0 || len(got) > 2 {
+		t.Errorf("wrote batches of %v, want the two logs in one or two", got)
+	}
+}
+
+func TestBatcherReportsWriteErrors(t *testing.T) {
+	broken := errors.New("disk full")
+	b := NewBatcher(&recorder{err: broken}, 2, time.Hour)
+	defer b.Close()
+	for i, err := range addAll(t, b, 2) {
+		if !errors.Is(err, broken) {
+			t.Errorf("add %d: %v, want %v", i, err, broken)
+		}
+	}
+}
+
+func TestBatcherCloseWritesPending(t *testing.T) {
+	broken := errors.New("close failed")
+	sink := &recorder{closeErr: broken}
+	b := NewBatcher(sink, 10, time.Hour)
+	added := make(chan error)
+	go func() { added <- b.Add(context.Background(), gameLog("bob", 1)) }()
+	// Give the batcher time to take the log; it then waits for more.
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-added:
+		t.Fatalf("Add returned %v before the batch was written", err)
+	default:
+	}
+
+	if err := b.Close(); !errors.Is(err, broken) {
+		t.Errorf("Close returned %v, want the sink's %v", err, broken)
+	}
+	select {
+	case err := <-added:
+		if err != nil {
+			t.Errorf("pending add: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("pending Add did not return")
+	}
+	if got := sink.sizes(); len(got) != 1 || got[0] != 1 {
+		t.Errorf("wrote batches of %v, want the pending log", got)
+	}
+	if !sink.closed {
+		t.Error("sink not closed")
+	}
+	if err := b.Add(context.Background(), gameLog("bob", 2)); !errors.Is(err, ErrClosed) {
+		t.Errorf("add after close: %v, want %v", err, ErrClosed)
+	}
+	if err := b.Close(); !errors.Is(err, broken) {
+		t.Errorf("second Close returned %v", err)
+	}
+}
+
+func TestBatcherAddCancelled(t *testing.T) {
+	b := NewBatcher(&recorder{}, 10, time.Hour)
+	defer b.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := b.Add(ctx, gameLog("bob", 1)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,134 @@
+package logsink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tdabry/learn-pub-sub-starter/internal/routing"
+)
+
+// Rotation says when a file sink starts a new file. The old one is
+// renamed with the time it was rotated appended. Zero fields never rotate.
+type Rotation struct {
+	MaxBytes int64
+	MaxAge   time.Duration
+}
+
+// FileSink appends logs to a file, one per line, as text or JSON.
+type FileSink struct {
+	path     string
+	rotation Rotation
+	format   func(routing.GameLog) ([]byte, error)
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// NewFileSink writes the text format of FormatText.
+func NewFileSink(path string, rotation Rotation) (*FileSink, error) {
+	return newFileSink(path, rotation, func(lg routing.GameLog) ([]byte, error) {
+		return []byte(FormatText(lg)), nil
+	})
+}
+
+// NewJSONLSink writes one JSON object per line.
+func NewJSONLSink(path string, rotation Rotation) (*FileSink, error) {
+	return newFileSink(path, rotation, func(lg routing.GameLog) ([]byte, error) {
+		data, err := json.Marshal(lg)
+		return append(data, '\n'), err
+	})
+}
+
+func newFileSink(path string, rotation Rotation, format func(routing.GameLog) ([]byte, error)) (*FileSink, error) {
+	s := &FileSink{path: path, rotation: rotation, format: format}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open logs file: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size, s.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+func (s *FileSink) Write(ctx context.Context, logs []routing.GameLog) error {
+	var buf []byte
+	for _, lg := range logs {
+		line, err := s.format(lg)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, line...)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return ErrClosed
+	}
+	if s.due(int64(len(buf))) {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(buf)
+	s.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("could not write to logs file: %v", err)
+	}
+	return nil
+}
+
+func (s *FileSink) due(n int64) bool {
+	if s.size == 0 {
+		return false
+	}
+	r := s.rotation
+	return r.MaxBytes > 0 && s.size+n > r.MaxBytes ||
+		r.MaxAge > 0 && time.Since(s.opened) >= r.MaxAge
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	s.f = nil
+	stamp := time.Now().UTC().Format("20060102T150405")
+	name := s.path + "." + stamp
+	for i := 1; ; i++ {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			break
+		}
+		name = fmt.Sprintf("%s.%s.%d", s.path, stamp, i)
+	}
+	if err := os.Rename(s.path, name); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
@@ -0,0 +1,122 @@
+package logsink
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tdabry/learn-pub-sub-starter/internal/routing"
+)
+
+// readLogs parses every line of the file at path.
+func readLogs(t *testing.T, path string) []routing.GameLog {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs []routing.GameLog
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		lg, err := ParseLine(line)
+		if err != nil {
+			t.Fatalf("%s: %v", filepath.Base(path), err)
+		}
+		logs = append(logs, lg)
+	}
+	return logs
+}
+
+func TestFileSinkRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		open func(string, Rotation) (*FileSink, error)
+		// precision is what the format keeps of the log time.
+		precision time.Duration
+	}{
+		{"text", NewFileSink, time.Second},
+		{"jsonl", NewJSONLSink, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "game.log")
+			first := []routing.GameLog{gameLog("bob", 1), {
+				CurrentTime: time.Date(2024, 1, 2, 3, 4, 5, 6000, time.UTC),
+				Username:    "alice",
+				Message:     "alice: took europe",
+			}}
+			second := []routing.GameLog{gameLog("carol", 3)}
+
+			s, err := tt.open(path, Rotation{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Write(context.Background(), first); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Write(context.Background(), second); !errors.Is(err, ErrClosed) {
+				t.Errorf("write after close: %v, want %v", err, ErrClosed)
+			}
+			// Reopening appends.
+			if s, err = tt.open(path, Rotation{}); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Write(context.Background(), second); err != nil {
+				t.Fatal(err)
+			}
+			s.Close()
+
+			want := append(first, second...)
+			for i := range want {
+				if tt.precision > 0 {
+					want[i].CurrentTime = want[i].CurrentTime.Truncate(tt.precision)
+				}
+			}
+			if got := readLogs(t, path); !reflect.DeepEqual(got, want) {
+				t.Errorf("read back\n%+v\nwant\n%+v", got, want)
+			}
+		})
+	}
+}
+
+func TestFileSinkRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "game.log")
+	line := int64(len(FormatText(gameLog("bob", 1))))
+	s, err := NewFileSink(path, Rotation{MaxBytes: 2 * line})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 1; i <= 5; i++ {
+		if err := s.Write(context.Background(), []routing.GameLog{gameLog("bob", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotated, err := rotatedFiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 2 {
+		t.Fatalf("rotated to %v, want two files", rotated)
+	}
+	var seconds []int
+	for _, name := range append(rotated, path) {
+		logs := readLogs(t, name)
+		if len(logs) > 2 {
+			t.Errorf("%s holds %d logs, over MaxBytes", filepath.Base(name), len(logs))
+		}
+		for _, lg := range logs {
+			seconds = append(seconds, lg.CurrentTime.Second())
+		}
+	}
+	if !reflect.DeepEqual(seconds, []int{1, 2, 3, 4, 5}) {
+		t.Errorf("logs in file order %v, want 1 to 5", seconds)
+	}
+}
@@ -0,0 +1,67 @@
+package logsink
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/tdabry/learn-pub-sub-starter/internal/routing"
+)
+
+// QueryFlags are the command-line options shared by everything that
+// queries game logs. Words left after the flags are the text to look for.
+type QueryFlags struct {
+	Query
+	Follow bool
+	JSON   bool
+
+	since, until string
+}
+
+func (f *QueryFlags) Register(fs *flag.FlagSet) {
+	fs.StringVar(&f.Username, "user", "", "only logs from this player")
+	fs.StringVar(&f.since, "since", "", "only logs at or after this time (RFC 3339, or a duration ago like 1h)")
+	fs.StringVar(&f.until, "until", "", "only logs before this time (RFC 3339, or a duration ago)")
+	fs.BoolVar(&f.Follow, "f", false, "keep printing new logs as they are written")
+	fs.BoolVar(&f.JSON, "json", false, "print logs as JSON lines")
+}
+
+// Resolve fills in Query from the parsed flags and the remaining words.
+func (f *QueryFlags) Resolve(words []string, now time.Time) error {
+	var err error
+	if f.Since, err = ParseTime(f.since, now); err != nil {
+		return fmt.Errorf("-since: %v", err)
+	}
+	if f.Until, err = ParseTime(f.until, now); err != nil {
+		return fmt.Errorf("-until: %v", err)
+	}
+	if !f.Until.IsZero() && f.Until.Before(f.Since) {
+		return fmt.Errorf("-until %s is before -since %s", f.Until.Format(time.RFC3339), f.Since.Format(time.RFC3339))
+	}
+	f.Contains = strings.Join(words, " ")
+	return nil
+}
+
+// Print writes lg to w in the format the flags ask for.
+func (f *QueryFlags) Print(w io.Writer, lg routing.GameLog) error {
+	if !f.JSON {
+		_, err := io.WriteString(w, FormatText(lg))
+		return err
+	}
+	return json.NewEncoder(w).Encode(lg)
+}
+
+// ParseTime reads an RFC 3339 time, or a duration meaning that long before
+// now. An empty string is the zero time.
+func ParseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,69 @@
+package logsink
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryFlags(t *testing.T) {
+	now := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		args    string
+		want    Query
+		follow  bool
+		wantErr string
+	}{
+		{args: "", want: Query{}},
+		{args: "-user bob -f", want: Query{Username: "bob"}, follow: true},
+		{args: "-since 1h -until 30m", want: Query{Since: now.Add(-time.Hour), Until: now.Add(-30 * time.Minute)}},
+		{args: "-since 2024-01-02T03:04:05Z", want: Query{Since: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}},
+		{args: "-until 2h won a war", want: Query{Until: now.Add(-2 * time.Hour), Contains: "won a war"}},
+		{args: "-since 1h -until 1h", want: Query{Since: now.Add(-time.Hour), Until: now.Add(-time.Hour)}},
+		{args: "-since 30m -until 1h", wantErr: "-until"},
+		{args: "-since yesterday", wantErr: "-since"},
+		{args: "-until 2024-13-01T00:00:00Z", wantErr: "-until"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.args, func(t *testing.T) {
+			var qf QueryFlags
+			fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+			qf.Register(fs)
+			if err := fs.Parse(strings.Fields(tt.args)); err != nil {
+				t.Fatal(err)
+			}
+			err := qf.Resolve(fs.Args(), now)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Errorf("got %v, want a %s error", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if qf.Query != tt.want || qf.Follow != tt.follow {
+				t.Errorf("got %+v follow %v, want %+v follow %v", qf.Query, qf.Follow, tt.want, tt.follow)
+			}
+		})
+	}
+}
+
+func TestQueryFlagsPrint(t *testing.T) {
+	lg := gameLog("bob", 1)
+	var buf bytes.Buffer
+	qf := QueryFlags{}
+	if err := qf.Print(&buf, lg); err != nil || buf.String() != FormatText(lg) {
+		t.Errorf("text: %q, %v", buf.String(), err)
+	}
+	buf.Reset()
+	qf.JSON = true
+	if err := qf.Print(&buf, lg); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ParseLine(strings.TrimSuffix(buf.String(), "\n")); err != nil || got != lg {
+		t.Errorf("json %q read back as %+v, %v", buf.String(), got, err)
+	}
+}
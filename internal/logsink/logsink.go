@@ -0,0 +1,104 @@
+// Package logsink stores the game logs the server consumes. A Sink takes
+// logs in batches; Batcher groups single logs into batches, Multi fans
+// them out to several sinks and Throttle slows a sink down.
+package logsink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tdabry/learn-pub-sub-starter/internal/routing"
+)
+
+type Sink interface {
+	Write(ctx context.Context, logs []routing.GameLog) error
+	Close() error
+}
+
+// FormatText is the line format game.log has always used.
+func FormatText(lg routing.GameLog) string {
+	return fmt.Sprintf("%v %v: %v\n", lg.CurrentTime.Format(time.RFC3339), lg.Username, lg.Message)
+}
+
+// WriterSink writes logs as text lines to w, such as os.Stdout.
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+func Stdout() *WriterSink {
+	return NewWriterSink(os.Stdout)
+}
+
+func (s *WriterSink) Write(ctx context.Context, logs []routing.GameLog) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, lg := range logs {
+		if _, err := io.WriteString(s.w, FormatText(lg)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *WriterSink) Close() error { return nil }
+
+type multi []Sink
+
+// Multi writes every batch to all of sinks. A batch fails if any sink
+// fails, so a retried batch may be written twice to the sinks that took
+// it the first time.
+func Multi(sinks ...Sink) Sink {
+	if len(sinks) == 1 {
+		return sinks[0]
+	}
+	return multi(sinks)
+}
+
+func (m multi) Write(ctx context.Context, logs []routing.GameLog) error {
+	var errs []error
+	for _, s := range m {
+		errs = append(errs, s.Write(ctx, logs))
+	}
+	return errors.Join(errs...)
+}
+
+func (m multi) Close() error {
+	var errs []error
+	for _, s := range m {
+		errs = append(errs, s.Close())
+	}
+	return errors.Join(errs...)
+}
+
+type throttle struct {
+	Sink
+	d time.Duration
+}
+
+// Throttle waits d before every batch it passes on to s. It stands in for
+// slow storage when testing how the server copes with a backlog.
+func Throttle(s Sink, d time.Duration) Sink {
+	if d <= 0 {
+		return s
+	}
+	return throttle{Sink: s, d: d}
+}
+
+func (t throttle) Write(ctx context.Context, logs []routing.GameLog) error {
+	select {
+	case <-time.After(t.d):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return t.Sink.Write(ctx, logs)
+}
@@ -0,0 +1,52 @@
+package logsink
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/tdabry/learn-pub-sub-starter/internal/routing"
+)
+
+func TestMulti(t *testing.T) {
+	single := &recorder{}
+	if Multi(single) != Sink(single) {
+		t.Error("Multi of one sink wraps it")
+	}
+
+	errA, errB := errors.New("a failed"), errors.New("b failed")
+	ok, a, b := &recorder{}, &recorder{err: errA, closeErr: errA}, &recorder{err: errB}
+	m := Multi(a, ok, b)
+	logs := []routing.GameLog{gameLog("bob", 1), gameLog("alice", 2)}
+	err := m.Write(context.Background(), logs)
+	if !errors.Is(err, errA) || !errors.Is(err, errB) {
+		t.Errorf("Write returned %v, want both errors", err)
+	}
+	for i, s := range []*recorder{a, ok, b} {
+		if got := s.sizes(); len(got) != 1 || got[0] != len(logs) {
+			t.Errorf("sink %d got batches of %v", i, got)
+		}
+	}
+	if err := m.Close(); !errors.Is(err, errA) || errors.Is(err, errB) {
+		t.Errorf("Close returned %v, want only %v", err, errA)
+	}
+	if !a.closed || !ok.closed || !b.closed {
+		t.Error("Close skipped a sink after an error")
+	}
+	if err := Multi(&recorder{}, &recorder{}).Write(context.Background(), logs); err != nil {
+		t.Errorf("Write to healthy sinks: %v", err)
+	}
+}
+
+func TestWriterSink(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewWriterSink(&buf)
+	if err := s.Write(context.Background(), []routing.GameLog{gameLog("bob", 1), gameLog("alice", 2)}); err != nil {
+		t.Fatal(err)
+	}
+	want := "2024-01-02T03:04:01Z bob: message 1\n2024-01-02T03:04:02Z alice: message 2\n"
+	if buf.String() != want {
+		t.Errorf("wrote %q, want %q", buf.String(), want)
+	}
+}
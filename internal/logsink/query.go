@@ -0,0 +1,266 @@
+package logsink
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tdabry/learn-pub-sub-starter/internal/routing"
+)
+
+// Query selects stored game logs. Zero fields match everything.
+type Query struct {
+	Username string
+	Since    time.Time
+	Until    time.Time
+	Contains string
+}
+
+func (q Query) Match(lg routing.GameLog) bool {
+	switch {
+	case q.Username != "" && lg.Username != q.Username:
+		return false
+	case !q.Since.IsZero() && lg.CurrentTime.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !lg.CurrentTime.Before(q.Until):
+		return false
+	}
+	return strings.Contains(lg.Message, q.Contains)
+}
+
+// Searcher is a sink whose logs can be read back. Search calls fn for the
+// stored logs matching q, oldest first. Follow does the same and then
+// keeps calling fn for new logs until ctx is done.
+type Searcher interface {
+	Search(ctx context.Context, q Query, fn func(routing.GameLog) error) error
+	Follow(ctx context.Context, q Query, fn func(routing.GameLog) error) error
+}
+
+// pollInterval is how often Follow looks for new logs.
+const pollInterval = 250 * time.Millisecond
+
+// ParseLine reads a line written by a file or JSON-lines sink.
+func ParseLine(line string) (routing.GameLog, error) {
+	var lg routing.GameLog
+	if strings.HasPrefix(line, "{") {
+		err := json.Unmarshal([]byte(line), &lg)
+		return lg, err
+	}
+	stamp, rest, ok := strings.Cut(line, " ")
+	username, msg, ok2 := strings.Cut(rest, ": ")
+	if !ok || !ok2 {
+		return lg, fmt.Errorf("malformed game log %q", line)
+	}
+	t, err := time.Parse(time.RFC3339, stamp)
+	if err != nil {
+		return lg, err
+	}
+	return routing.GameLog{CurrentTime: t, Username: username, Message: msg}, nil
+}
+
+func (s *FileSink) Search(ctx context.Context, q Query, fn func(routing.GameLog) error) error {
+	return SearchFile(ctx, s.path, q, fn)
+}
+
+func (s *FileSink) Follow(ctx context.Context, q Query, fn func(routing.GameLog) error) error {
+	return FollowFile(ctx, s.path, q, fn)
+}
+
+// SearchFile searches the file at path, after the files it was rotated to.
+// Lines that cannot be parsed are skipped.
+func SearchFile(ctx context.Context, path string, q Query, fn func(routing.GameLog) error) error {
+	rotated, err := rotatedFiles(path)
+	if err != nil {
+		return err
+	}
+	for _, name := range append(rotated, path) {
+		if err := searchOne(ctx, name, q, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func searchOne(ctx context.Context, name string, q Query, fn func(routing.GameLog) error) error {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	var partial string
+	_, err = scanLogs(ctx, bufio.NewReader(f), &partial, q, fn)
+	return err
+}
+
+// rotatedFiles lists the files a sink rotated path to, oldest first.
+func rotatedFiles(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// FollowFile is SearchFile followed by tail -f on path. It starts over at
+// the top of the file when the sink rotates it; like tail -F it misses a
+// file that is rotated away again within one poll.
+func FollowFile(ctx context.Context, path string, q Query, fn func(routing.GameLog) error) error {
+	rotated, err := rotatedFiles(path)
+	if err != nil {
+		return err
+	}
+	for _, name := range rotated {
+		if err := searchOne(ctx, name, q, fn); err != nil {
+			return err
+		}
+	}
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	var r *bufio.Reader
+	var offset int64
+	var partial string
+	for {
+		if f == nil {
+			if f, err = os.Open(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			r, offset, partial = bufio.NewReader(f), 0, ""
+		}
+		if f != nil {
+			n, err := scanLogs(ctx, r, &partial, q, fn)
+			offset += n
+			if err != nil {
+				return err
+			}
+			if info, err := os.Stat(path); err != nil || info.Size() < offset || !sameFile(f, info) {
+				// Finish what was written before the rotation.
+				if _, err := scanLogs(ctx, r, &partial, q, fn); err != nil {
+					return err
+				}
+				f.Close()
+				f = nil
+				continue
+			}
+		}
+		select {
+		case <-time.After(pollInterval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func sameFile(f *os.File, info os.FileInfo) bool {
+	fi, err := f.Stat()
+	return err == nil && os.SameFile(fi, info)
+}
+
+// scanLogs reads complete lines from r until EOF and returns how many bytes
+// it consumed. A partial last line is kept in partial for the next call.
+func scanLogs(ctx context.Context, r *bufio.Reader, partial *string, q Query, fn func(routing.GameLog) error) (int64, error) {
+	var n int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return n, nil
+		}
+		line, err := r.ReadString('\n')
+		n += int64(len(line))
+		if errors.Is(err, io.EOF) {
+			*partial += line
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		line, *partial = *partial+line, ""
+		lg, err := ParseLine(strings.TrimSuffix(line, "\n"))
+		if err != nil || !q.Match(lg) {
+			continue
+		}
+		if err := fn(lg); err != nil {
+			return n, err
+		}
+	}
+}
+
+func (s *SQLSink) Search(ctx context.Context, q Query, fn func(routing.GameLog) error) error {
+	_, err := SearchSQL(ctx, s.db, q, 0, fn)
+	return err
+}
+
+func (s *SQLSink) Follow(ctx context.Context, q Query, fn func(routing.GameLog) error) error {
+	return FollowSQL(ctx, s.db, q, fn)
+}
+
+// SearchSQL searches the game_logs table for rows after id afterID and
+// returns the last id it saw.
+func SearchSQL(ctx context.Context, db *sql.DB, q Query, afterID int64, fn func(routing.GameLog) error) (int64, error) {
+	query := `SELECT id, time, username, message FROM game_logs WHERE id > ?`
+	args := []any{afterID}
+	if q.Username != "" {
+		query += ` AND username = ?`
+		args = append(args, q.Username)
+	}
+	if !q.Since.IsZero() {
+		query += ` AND time >= ?`
+		args = append(args, q.Since.UTC())
+	}
+	if !q.Until.IsZero() {
+		query += ` AND time < ?`
+		args = append(args, q.Until.UTC())
+	}
+	if q.Contains != "" {
+		query += ` AND instr(message, ?) > 0`
+		args = append(args, q.Contains)
+	}
+	rows, err := db.QueryContext(ctx, query+` ORDER BY id`, args...)
+	if err != nil {
+		return afterID, err
+	}
+	defer rows.Close()
+	last := afterID
+	for rows.Next() {
+		var lg routing.GameLog
+		if err := rows.Scan(&last, &lg.CurrentTime, &lg.Username, &lg.Message); err != nil {
+			return last, err
+		}
+		if err := fn(lg); err != nil {
+			return last, err
+		}
+	}
+	return last, rows.Err()
+}
+
+// FollowSQL is SearchSQL followed by polling for newly inserted rows.
+func FollowSQL(ctx context.Context, db *sql.DB, q Query, fn func(routing.GameLog) error) error {
+	var last int64
+	for {
+		var err error
+		last, err = SearchSQL(ctx, db, q, last, fn)
+		if ctx.Err() != nil {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		select {
+		case <-time.After(pollInterval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package logsink
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tdabry/learn-pub-sub-starter/internal/routing"
+)
+
+// fixture is the game logs every searcher is loaded with, a second apart.
+var fixture = []routing.GameLog{
+	{Username: "bob", Message: "bob joined"},
+	{Username: "alice", Message: "alice joined"},
+	{Username: "bob", Message: "bob won a war against alice"},
+	{Username: "alice", Message: "alice lost a war"},
+	{Username: "carol", Message: "carol joined"},
+}
+
+var fixtureStart = time.Date(2024, 1, 2, 3, 4, 0, 0, time.UTC)
+
+func init() {
+	for i := range fixture {
+		fixture[i].CurrentTime = fixtureStart.Add(time.Duration(i) * time.Second)
+	}
+}
+
+// searchSink is a sink that can be searched, opened in a fresh directory.
+type searchSink interface {
+	Sink
+	Searcher
+}
+
+var searchSinks = []struct {
+	name string
+	open func(t *testing.T, dir string) searchSink
+}{
+	{"text", func(t *testing.T, dir string) searchSink {
+		s, err := NewFileSink(filepath.Join(dir, "game.log"), Rotation{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}},
+	{"jsonl", func(t *testing.T, dir string) searchSink {
+		s, err := NewJSONLSink(filepath.Join(dir, "game.jsonl"), Rotation{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}},
+	{"sqlite", func(t *testing.T, dir string) searchSink {
+		return openSQLite(t, filepath.Join(dir, "logs.db"))
+	}},
+}
+
+func messages(logs []routing.GameLog) []string {
+	var msgs []string
+	for _, lg := range logs {
+		msgs = append(msgs, lg.Message)
+	}
+	return msgs
+}
+
+func TestSearch(t *testing.T) {
+	at := func(i int) time.Time { return fixture[i].CurrentTime }
+	tests := []struct {
+		name  string
+		query Query
+		want  []int
+	}{
+		{"everything", Query{}, []int{0, 1, 2, 3, 4}},
+		{"user", Query{Username: "alice"}, []int{1, 3}},
+		{"since", Query{Since: at(3)}, []int{3, 4}},
+		{"until", Query{Until: at(2)}, []int{0, 1}},
+		{"time range", Query{Since: at(1), Until: at(3)}, []int{1, 2}},
+		{"text", Query{Contains: "war"}, []int{2, 3}},
+		{"all filters", Query{Username: "bob", Since: at(1), Until: at(4), Contains: "war"}, []int{2}},
+		{"no match", Query{Username: "dave"}, nil},
+		{"text matches case", Query{Contains: "War"}, nil},
+		{"inverted range", Query{Since: at(3), Until: at(1)}, nil},
+		{"empty range", Query{Since: at(2), Until: at(2)}, nil},
+	}
+	for _, sink := range searchSinks {
+		t.Run(sink.name, func(t *testing.T) {
+			s := sink.open(t, t.TempDir())
+			defer s.Close()
+			if err := s.Write(context.Background(), fixture); err != nil {
+				t.Fatal(err)
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					var got []routing.GameLog
+					err := s.Search(context.Background(), tt.query, func(lg routing.GameLog) error {
+						got = append(got, lg)
+						return nil
+					})
+					if err != nil {
+						t.Fatal(err)
+					}
+					var want []routing.GameLog
+					for _, i := range tt.want {
+						want = append(want, fixture[i])
+					}
+					if !reflect.DeepEqual(got, want) {
+						t.Errorf("found %q, want %q", messages(got), messages(want))
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestSearchStopsOnError(t *testing.T) {
+	stop := errors.New("enough")
+	for _, sink := range searchSinks {
+		t.Run(sink.name, func(t *testing.T) {
+			s := sink.open(t, t.TempDir())
+			defer s.Close()
+			if err := s.Write(context.Background(), fixture); err != nil {
+				t.Fatal(err)
+			}
+			var n int
+			err := s.Search(context.Background(), Query{}, func(routing.GameLog) error {
+				n++
+				return stop
+			})
+			if !errors.Is(err, stop) || n != 1 {
+				t.Errorf("got %v after %d logs, want %v after one", err, n, stop)
+			}
+		})
+	}
+}
+
+func TestSearchMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "game.log")
+	err := SearchFile(context.Background(), path, Query{}, func(lg routing.GameLog) error {
+		t.Errorf("found %+v", lg)
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSearchFileSkipsDamagedLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "game.log")
+	text := FormatText(fixture[0]) + "not a game log\n" + FormatText(fixture[1]) + "2024-01-02T03:04:05Z half a li"
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var got []routing.GameLog
+	if err := SearchFile(context.Background(), path, Query{}, func(lg routing.GameLog) error {
+		got = append(got, lg)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, fixture[:2]) {
+		t.Errorf("found %q, want the two whole logs", messages(got))
+	}
+}
+
+// follow runs s.Follow in the background and returns the logs it finds
+// and a function that stops it and returns its error.
+func follow(t *testing.T, s Searcher, q Query) (<-chan routing.GameLog, func() error) {
+	t.Helper()
+	found := make(chan routing.GameLog, 16)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Follow(ctx, q, func(lg routing.GameLog) error {
+			found <- lg
+			return nil
+		})
+	}()
+	return found, func() error {
+		cancel()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(2 * time.Second):
+			t.Fatal("Follow did not stop")
+			return nil
+		}
+	}
+}
+
+func expectLogs(t *testing.T, found <-chan routing.GameLog, want ...routing.GameLog) {
+	t.Helper()
+	for _, lg := range want {
+		select {
+		case got := <-found:
+			if !reflect.DeepEqual(got, lg) {
+				t.Errorf("followed %q, want %q", got.Message, lg.Message)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%q not followed", lg.Message)
+		}
+	}
+	select {
+	case got := <-found:
+		t.Errorf("followed %q, want nothing more", got.Message)
+	case <-time.After(2 * pollInterval):
+	}
+}
+
+func TestFollow(t *testing.T) {
+	for _, sink := range searchSinks {
+		t.Run(sink.name, func(t *testing.T) {
+			s := sink.open(t, t.TempDir())
+			defer s.Close()
+			if err := s.Write(context.Background(), fixture[:3]); err != nil {
+				t.Fatal(err)
+			}
+			found, stop := follow(t, s, Query{Username: "alice"})
+			expectLogs(t, found, fixture[1])
+			if err := s.Write(context.Background(), fixture[3:]); err != nil {
+				t.Fatal(err)
+			}
+			expectLogs(t, found, fixture[3])
+			if err := stop(); err != nil {
+				t.Errorf("Follow returned %v", err)
+			}
+		})
+	}
+}
+
+func TestFollowFileAcrossRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "game.log")
+	line := int64(len(FormatText(fixture[0])))
+	s, err := NewFileSink(path, Rotation{MaxBytes: 2 * line})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Write(context.Background(), fixture[:1]); err != nil {
+		t.Fatal(err)
+	}
+	found, stop := follow(t, s, Query{})
+	expectLogs(t, found, fixture[0])
+	for _, lg := range fixture[1:] {
+		if err := s.Write(context.Background(), []routing.GameLog{lg}); err != nil {
+			t.Fatal(err)
+		}
+		expectLogs(t, found, lg)
+	}
+	if err := stop(); err != nil {
+		t.Errorf("Follow returned %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package logsink
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/tdabry/learn-pub-sub-starter/internal/routing"
+)
+
+// SQLSink stores logs in a game_logs table of a SQLite database. The
+// caller opens the database with the driver of its choice, with a busy
+// timeout so the server and a following reader wait out each other's
+// locks instead of failing; see SQLiteDSN.
+type SQLSink struct {
+	db *sql.DB
+}
+
+// SQLiteDSN is the data source name for the database at path with
+// modernc.org/sqlite, the driver the commands use, waiting up to five
+// seconds for a lock.
+func SQLiteDSN(path string) string {
+	return "file:" + path + "?_pragma=busy_timeout(5000)"
+}
+
+const createGameLogs = `CREATE TABLE IF NOT EXISTS game_logs (
+	id INTEGER PRIMARY KEY,
+	time TIMESTAMP NOT NULL,
+	username TEXT NOT NULL,
+	message TEXT NOT NULL
+)`
+
+// NewSQLSink creates the game_logs table if it does not exist yet.
+func NewSQLSink(db *sql.DB) (*SQLSink, error) {
+	if _, err := db.Exec(createGameLogs); err != nil {
+		return nil, err
+	}
+	return &SQLSink{db: db}, nil
+}
+
+// Write inserts the batch in one transaction.
+func (s *SQLSink) Write(ctx context.Context, logs []routing.GameLog) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO game_logs (time, username, message) VALUES (?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, lg := range logs {
+		if _, err := stmt.ExecContext(ctx, lg.CurrentTime.UTC(), lg.Username, lg.Message); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLSink) Close() error {
+	return s.db.Close()
+}
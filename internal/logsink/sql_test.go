@@ -0,0 +1,90 @@
+package logsink
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tdabry/learn-pub-sub-starter/internal/routing"
+	_ "modernc.org/sqlite"
+)
+
+func openSQLite(t *testing.T, path string) *SQLSink {
+	t.Helper()
+	db, err := sql.Open("sqlite", SQLiteDSN(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSQLSink(db)
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSQLSinkRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs.db")
+	first := []routing.GameLog{gameLog("bob", 1), {
+		CurrentTime: time.Date(2024, 1, 2, 3, 4, 5, 6000, time.FixedZone("CET", 3600)),
+		Username:    "alice",
+		Message:     "it's a 'quoted' war",
+	}}
+	second := []routing.GameLog{gameLog("carol", 3)}
+
+	s := openSQLite(t, path)
+	if err := s.Write(context.Background(), first); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	// Reopening keeps the table and its rows.
+	s = openSQLite(t, path)
+	defer s.Close()
+	if err := s.Write(context.Background(), second); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := s.db.Query(`SELECT time, username, message FROM game_logs ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []routing.GameLog
+	for rows.Next() {
+		var lg routing.GameLog
+		if err := rows.Scan(&lg.CurrentTime, &lg.Username, &lg.Message); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, lg)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := append(first, second...)
+	for i := range want {
+		want[i].CurrentTime = want[i].CurrentTime.UTC()
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("read back\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestSQLSinkWriteIsAtomic(t *testing.T) {
+	s := openSQLite(t, filepath.Join(t.TempDir(), "logs.db"))
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Write(ctx, []routing.GameLog{gameLog("bob", 1), gameLog("bob", 2)}); err == nil {
+		t.Fatal("wrote with a cancelled context")
+	}
+	var n int
+	if err := s.db.QueryRow(`SELECT count(*) FROM game_logs`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("%d rows stored from a failed batch", n)
+	}
+}
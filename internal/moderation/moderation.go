@@ -0,0 +1,141 @@
+// Package moderation limits how many game logs each player can have
+// written and flags the players who keep going over their quota.
+package moderation
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tdabry/learn-pub-sub-starter/internal/routing"
+)
+
+// Quota is a token bucket: Burst logs at once, refilled at Rate per
+// second. A Rate of zero or less means no limit.
+type Quota struct {
+	Rate  float64
+	Burst int
+}
+
+func (q Quota) String() string {
+	return fmt.Sprintf("%g:%d", q.Rate, q.Burst)
+}
+
+// ParseQuota reads a quota written as "rate:burst", such as "5:20".
+func ParseQuota(s string) (Quota, error) {
+	rate, burst, ok := strings.Cut(s, ":")
+	if !ok {
+		return Quota{}, fmt.Errorf("quota %q is not rate:burst", s)
+	}
+	var q Quota
+	var err error
+	if q.Rate, err = strconv.ParseFloat(rate, 64); err != nil {
+		return Quota{}, fmt.Errorf("quota %q: %v", s, err)
+	}
+	if q.Burst, err = strconv.Atoi(burst); err != nil {
+		return Quota{}, fmt.Errorf("quota %q: %v", s, err)
+	}
+	if q.Rate > 0 && q.Burst < 1 {
+		return Quota{}, fmt.Errorf("quota %q: burst must be at least 1", s)
+	}
+	return q, nil
+}
+
+type Policy struct {
+	Default Quota
+	Users   map[string]Quota
+
+	// A player is flagged once FlagAfter of their logs are dropped within
+	// FlagWindow. Zero FlagAfter never flags anyone.
+	FlagAfter  int
+	FlagWindow time.Duration
+}
+
+func (p Policy) quota(username string) Quota {
+	if q, ok := p.Users[username]; ok {
+		return q
+	}
+	return p.Default
+}
+
+type Moderator struct {
+	policy Policy
+
+	mu      sync.Mutex
+	players map[string]*player
+}
+
+type player struct {
+	tokens  float64
+	refill  time.Time
+	since   time.Time
+	dropped int
+	flagged bool
+	strikes int
+}
+
+func New(p Policy) *Moderator {
+	return &Moderator{policy: p, players: make(map[string]*player)}
+}
+
+// Check charges username for one log at now. It reports whether the log
+// is within quota, and returns an event the first time in a window that
+// the player is flagged.
+func (m *Moderator) Check(username string, now time.Time) (bool, *routing.Moderation) {
+	q := m.policy.quota(username)
+	if q.Rate <= 0 {
+		return true, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.players[username]
+	if !ok {
+		p = &player{tokens: float64(q.Burst), refill: now}
+		m.players[username] = p
+	}
+	p.tokens = min(float64(q.Burst), p.tokens+now.Sub(p.refill).Seconds()*q.Rate)
+	p.refill = now
+	if p.tokens >= 1 {
+		p.tokens--
+		return true, nil
+	}
+	return false, m.drop(username, p, now)
+}
+
+func (m *Moderator) drop(username string, p *player, now time.Time) *routing.Moderation {
+	if m.policy.FlagAfter <= 0 {
+		return nil
+	}
+	if p.since.IsZero() || now.Sub(p.since) >= m.policy.FlagWindow {
+		p.since, p.dropped, p.flagged = now, 0, false
+	}
+	p.dropped++
+	if p.flagged || p.dropped < m.policy.FlagAfter {
+		return nil
+	}
+	p.flagged = true
+	p.strikes++
+	return &routing.Moderation{
+		Username: username,
+		Reason:   "spam",
+		Dropped:  p.dropped,
+		Since:    p.since,
+		Time:     now,
+		Strikes:  p.strikes,
+	}
+}
+
+// Strikes reports how often each player has been flagged.
+func (m *Moderator) Strikes() map[string]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	strikes := make(map[string]int)
+	for name, p := range m.players {
+		if p.strikes > 0 {
+			strikes[name] = p.strikes
+		}
+	}
+	return strikes
+}
@@ -0,0 +1,178 @@
+package moderation
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseQuota(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Quota
+		wantErr bool
+	}{
+		{in: "5:20", want: Quota{Rate: 5, Burst: 20}},
+		{in: "0.5:1", want: Quota{Rate: 0.5, Burst: 1}},
+		{in: "0:0", want: Quota{}},
+		{in: "5", wantErr: true},
+		{in: "fast:20", wantErr: true},
+		{in: "5:lots", wantErr: true},
+		{in: "5:0", wantErr: true},
+	}
+	for _, tt := range tests {
+		q, err := ParseQuota(tt.in)
+		if (err != nil) != tt.wantErr || q != tt.want {
+			t.Errorf("ParseQuota(%q) = %v, %v; want %v, error %v", tt.in, q, err, tt.want, tt.wantErr)
+		}
+	}
+	if q := (Quota{Rate: 2.5, Burst: 4}); q.String() != "2.5:4" {
+		t.Errorf("String() = %q", q.String())
+	}
+}
+
+// check is one log charged to user at offset from the start of a test.
+// allowed is whether it is within quota and strike, if not zero, the
+// strike it must be flagged with.
+type check struct {
+	user    string
+	at      time.Duration
+	allowed bool
+	strike  int
+}
+
+// repeat is n checks of the same log at the same time.
+func repeat(n int, c check) []check {
+	checks := make([]check, n)
+	for i := range checks {
+		checks[i] = c
+	}
+	return checks
+}
+
+func join(checks ...[]check) []check {
+	var all []check
+	for _, c := range checks {
+		all = append(all, c...)
+	}
+	return all
+}
+
+func TestCheck(t *testing.T) {
+	spam := Policy{Default: Quota{Rate: 1, Burst: 2}, FlagAfter: 3, FlagWindow: time.Minute}
+	tests := []struct {
+		name    string
+		policy  Policy
+		checks  []check
+		strikes map[string]int
+	}{
+		{
+			name:   "no limit",
+			policy: Policy{FlagAfter: 1},
+			checks: repeat(100, check{"bob", 0, true, 0}),
+		},
+		{
+			name:   "burst then dropped",
+			policy: Policy{Default: Quota{Rate: 1, Burst: 3}},
+			checks: join(repeat(3, check{"bob", 0, true, 0}), repeat(5, check{"bob", 0, false, 0})),
+		},
+		{
+			name:   "refill",
+			policy: Policy{Default: Quota{Rate: 2, Burst: 2}},
+			checks: []check{
+				{"bob", 0, true, 0},
+				{"bob", 0, true, 0},
+				{"bob", 0, false, 0},
+				{"bob", 250 * time.Millisecond, false, 0},
+				{"bob", 500 * time.Millisecond, true, 0},
+				{"bob", 500 * time.Millisecond, false, 0},
+				// A long pause refills no more than the burst.
+				{"bob", time.Hour, true, 0},
+				{"bob", time.Hour, true, 0},
+				{"bob", time.Hour, false, 0},
+			},
+		},
+		{
+			name:   "players have separate buckets",
+			policy: Policy{Default: Quota{Rate: 1, Burst: 1}},
+			checks: []check{
+				{"bob", 0, true, 0},
+				{"bob", 0, false, 0},
+				{"alice", 0, true, 0},
+			},
+		},
+		{
+			name:   "per-player quota",
+			policy: Policy{Default: Quota{Rate: 1, Burst: 1}, Users: map[string]Quota{"server": {}, "alice": {Rate: 1, Burst: 3}}},
+			checks: join(
+				repeat(10, check{"server", 0, true, 0}),
+				repeat(3, check{"alice", 0, true, 0}),
+				[]check{{"alice", 0, false, 0}, {"bob", 0, true, 0}, {"bob", 0, false, 0}},
+			),
+		},
+		{
+			name:   "flagged at the threshold",
+			policy: spam,
+			checks: join(
+				repeat(2, check{"bob", 0, true, 0}),
+				repeat(2, check{"bob", 0, false, 0}),
+				[]check{{"bob", 0, false, 1}},
+				// Once a window.
+				repeat(10, check{"bob", time.Second / 2, false, 0}),
+			),
+			strikes: map[string]int{"bob": 1},
+		},
+		{
+			name:   "no flags without FlagAfter",
+			policy: Policy{Default: spam.Default},
+			checks: join(repeat(2, check{"bob", 0, true, 0}), repeat(10, check{"bob", 0, false, 0})),
+		},
+		{
+			name:   "window resets the count",
+			policy: spam,
+			checks: join(
+				repeat(2, check{"bob", 0, true, 0}),
+				repeat(2, check{"bob", 0, false, 0}),
+				// A window later the drops are counted afresh.
+				repeat(2, check{"bob", time.Minute, true, 0}),
+				repeat(2, check{"bob", time.Minute, false, 0}),
+				[]check{{"bob", time.Minute, false, 1}},
+				// And the player can be flagged again in the next one.
+				repeat(2, check{"bob", 2 * time.Minute, true, 0}),
+				repeat(2, check{"bob", 2 * time.Minute, false, 0}),
+				[]check{{"bob", 2 * time.Minute, false, 2}},
+			),
+			strikes: map[string]int{"bob": 2},
+		},
+	}
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New(tt.policy)
+			for i, c := range tt.checks {
+				allowed, flagged := m.Check(c.user, start.Add(c.at))
+				if allowed != c.allowed {
+					t.Fatalf("check %d (%s at %v): allowed %v, want %v", i, c.user, c.at, allowed, c.allowed)
+				}
+				switch {
+				case c.strike == 0 && flagged != nil:
+					t.Fatalf("check %d (%s at %v): flagged %+v", i, c.user, c.at, *flagged)
+				case c.strike != 0 && flagged == nil:
+					t.Fatalf("check %d (%s at %v): not flagged", i, c.user, c.at)
+				case c.strike != 0:
+					if flagged.Username != c.user || flagged.Strikes != c.strike || flagged.Dropped != tt.policy.FlagAfter ||
+						!flagged.Time.Equal(start.Add(c.at)) || flagged.Time.Sub(flagged.Since) >= tt.policy.FlagWindow {
+						t.Errorf("check %d: flagged %+v, want strike %d", i, *flagged, c.strike)
+					}
+				}
+			}
+			want := tt.strikes
+			if want == nil {
+				want = map[string]int{}
+			}
+			if got := m.Strikes(); !reflect.DeepEqual(got, want) {
+				t.Errorf("strikes %v, want %v", got, want)
+			}
+		})
+	}
+}
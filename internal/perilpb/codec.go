@@ -0,0 +1,500 @@
+// Package perilpb encodes Peril messages in the protobuf wire format
+// described by peril.proto.
+package perilpb
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/tdabry/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/tdabry/learn-pub-sub-starter/internal/routing"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const ContentType = "application/x-protobuf"
+
+// Codec implements pubsub.Codec for gamelogic.ArmyMove,
+// gamelogic.RecognitionOfWar, gamelogic.WarResolved, gamelogic.Intent,
+// gamelogic.StateDelta, routing.PlayingState, routing.GameLog and
+// routing.Moderation.
+type Codec struct{}
+
+func (Codec) ContentType() string { return ContentType }
+
+func (Codec) Marshal(v any) ([]byte, error) {
+	switch m := v.(type) {
+	case gamelogic.ArmyMove:
+		return appendArmyMove(nil, m), nil
+	case *gamelogic.ArmyMove:
+		return appendArmyMove(nil, *m), nil
+	case gamelogic.RecognitionOfWar:
+		return appendRecognitionOfWar(nil, m), nil
+	case *gamelogic.RecognitionOfWar:
+		return appendRecognitionOfWar(nil, *m), nil
+	case gamelogic.WarResolved:
+		return appendWarResolved(nil, m), nil
+	case *gamelogic.WarResolved:
+		return appendWarResolved(nil, *m), nil
+	case gamelogic.Intent:
+		return appendIntent(nil, m), nil
+	case *gamelogic.Intent:
+		return appendIntent(nil, *m), nil
+	case gamelogic.StateDelta:
+		return appendStateDelta(nil, m), nil
+	case *gamelogic.StateDelta:
+		return appendStateDelta(nil, *m), nil
+	case routing.PlayingState:
+		return appendPlayingState(nil, m), nil
+	case *routing.PlayingState:
+		return appendPlayingState(nil, *m), nil
+	case routing.GameLog:
+		return appendGameLog(nil, m), nil
+	case *routing.GameLog:
+		return appendGameLog(nil, *m), nil
+	case routing.Moderation:
+		return appendModeration(nil, m), nil
+	case *routing.Moderation:
+		return appendModeration(nil, *m), nil
+	}
+	return nil, fmt.Errorf("perilpb: cannot marshal %T", v)
+}
+
+func (Codec) Unmarshal(data []byte, v any) error {
+	switch m := v.(type) {
+	case *gamelogic.ArmyMove:
+		return decodeArmyMove(data, m)
+	case *gamelogic.RecognitionOfWar:
+		return decodeRecognitionOfWar(data, m)
+	case *gamelogic.WarResolved:
+		return decodeWarResolved(data, m)
+	case *gamelogic.Intent:
+		return decodeIntent(data, m)
+	case *gamelogic.StateDelta:
+		return decodeStateDelta(data, m)
+	case *routing.PlayingState:
+		return decodePlayingState(data, m)
+	case *routing.GameLog:
+		return decodeGameLog(data, m)
+	case *routing.Moderation:
+		return decodeModeration(data, m)
+	}
+	return fmt.Errorf("perilpb: cannot unmarshal into %T", v)
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+func appendUnit(b []byte, u gamelogic.Unit) []byte {
+	b = appendVarint(b, 1, uint64(int64(u.ID)))
+	b = appendString(b, 2, string(u.Rank))
+	return appendString(b, 3, string(u.Location))
+}
+
+func appendPlayer(b []byte, p gamelogic.Player) []byte {
+	b = appendString(b, 1, p.Username)
+	ids := make([]int, 0, len(p.Units))
+	for id := range p.Units {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		b = appendMessage(b, 2, appendUnit(nil, p.Units[id]))
+	}
+	return b
+}
+
+func appendArmyMove(b []byte, mv gamelogic.ArmyMove) []byte {
+	b = appendMessage(b, 1, appendPlayer(nil, mv.Player))
+	for _, u := range mv.Units {
+		b = appendMessage(b, 2, appendUnit(nil, u))
+	}
+	return appendString(b, 3, string(mv.ToLocation))
+}
+
+func appendRecognitionOfWar(b []byte, rw gamelogic.RecognitionOfWar) []byte {
+	b = appendMessage(b, 1, appendPlayer(nil, rw.Attacker))
+	b = appendMessage(b, 2, appendPlayer(nil, rw.Defender))
+	return appendString(b, 3, string(rw.Location))
+}
+
+// appendInts writes ids as a packed repeated int64.
+func appendInts(b []byte, num protowire.Number, ids []int) []byte {
+	if len(ids) == 0 {
+		return b
+	}
+	var packed []byte
+	for _, id := range ids {
+		packed = protowire.AppendVarint(packed, uint64(int64(id)))
+	}
+	return appendMessage(b, num, packed)
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendVarint(b, num, 1)
+}
+
+// appendWarResolved writes the casualties map as its map entries, sorted
+// by username so the same outcome always encodes the same way.
+func appendWarResolved(b []byte, wr gamelogic.WarResolved) []byte {
+	b = appendString(b, 1, wr.Attacker)
+	b = appendString(b, 2, wr.Defender)
+	b = appendString(b, 3, string(wr.Location))
+	b = appendString(b, 4, wr.Winner)
+	b = appendString(b, 5, wr.Loser)
+	names := make([]string, 0, len(wr.Casualties))
+	for name := range wr.Casualties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var entry []byte
+		entry = appendString(entry, 1, name)
+		entry = appendMessage(entry, 2, appendInts(nil, 1, wr.Casualties[name]))
+		b = appendMessage(b, 6, entry)
+	}
+	return b
+}
+
+func appendIntent(b []byte, in gamelogic.Intent) []byte {
+	b = appendString(b, 1, in.Username)
+	b = appendString(b, 2, string(in.Kind))
+	b = appendString(b, 3, string(in.Location))
+	b = appendString(b, 4, string(in.Rank))
+	b = appendInts(b, 5, in.UnitIDs)
+	return b
+}
+
+func appendStateDelta(b []byte, d gamelogic.StateDelta) []byte {
+	b = appendString(b, 1, d.Username)
+	b = appendString(b, 2, string(d.Kind))
+	b = appendBool(b, 3, d.Snapshot)
+	for _, u := range d.Units {
+		b = appendMessage(b, 4, appendUnit(nil, u))
+	}
+	b = appendInts(b, 5, d.Removed)
+	return appendString(b, 6, d.Rejected)
+}
+
+func appendPlayingState(b []byte, ps routing.PlayingState) []byte {
+	if ps.IsPaused {
+		b = appendVarint(b, 1, 1)
+	}
+	return b
+}
+
+// appendTimestamp writes a google.protobuf.Timestamp. The zero time.Time
+// is left out so it decodes back to the zero value.
+func appendTimestamp(b []byte, num protowire.Number, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	var ts []byte
+	ts = appendVarint(ts, 1, uint64(t.Unix()))
+	ts = appendVarint(ts, 2, uint64(t.Nanosecond()))
+	return appendMessage(b, num, ts)
+}
+
+func appendGameLog(b []byte, lg routing.GameLog) []byte {
+	b = appendTimestamp(b, 1, lg.CurrentTime)
+	b = appendString(b, 2, lg.Message)
+	return appendString(b, 3, lg.Username)
+}
+
+func appendModeration(b []byte, m routing.Moderation) []byte {
+	b = appendString(b, 1, m.Username)
+	b = appendString(b, 2, m.Reason)
+	b = appendVarint(b, 3, uint64(int64(m.Dropped)))
+	b = appendTimestamp(b, 4, m.Since)
+	b = appendTimestamp(b, 5, m.Time)
+	return appendVarint(b, 6, uint64(int64(m.Strikes)))
+}
+
+type field struct {
+	num    protowire.Number
+	typ    protowire.Type
+	varint uint64
+	bytes  []byte
+}
+
+// walk calls fn for every varint and length-delimited field in b and skips
+// anything else, so fields added to the schema later are ignored.
+func walk(b []byte, fn func(f field) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		f := field{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.varint, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ != protowire.VarintType && typ != protowire.BytesType {
+			continue
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeUnit(b []byte, u *gamelogic.Unit) error {
+	return walk(b, func(f field) error {
+		switch f.num {
+		case 1:
+			u.ID = int(int64(f.varint))
+		case 2:
+			u.Rank = gamelogic.UnitRank(f.bytes)
+		case 3:
+			u.Location = gamelogic.Location(f.bytes)
+		}
+		return nil
+	})
+}
+
+func decodePlayer(b []byte, p *gamelogic.Player) error {
+	p.Units = map[int]gamelogic.Unit{}
+	return walk(b, func(f field) error {
+		switch f.num {
+		case 1:
+			p.Username = string(f.bytes)
+		case 2:
+			var u gamelogic.Unit
+			if err := decodeUnit(f.bytes, &u); err != nil {
+				return err
+			}
+			p.Units[u.ID] = u
+		}
+		return nil
+	})
+}
+
+func decodeArmyMove(b []byte, mv *gamelogic.ArmyMove) error {
+	*mv = gamelogic.ArmyMove{Units: []gamelogic.Unit{}}
+	return walk(b, func(f field) error {
+		switch f.num {
+		case 1:
+			return decodePlayer(f.bytes, &mv.Player)
+		case 2:
+			var u gamelogic.Unit
+			if err := decodeUnit(f.bytes, &u); err != nil {
+				return err
+			}
+			mv.Units = append(mv.Units, u)
+		case 3:
+			mv.ToLocation = gamelogic.Location(f.bytes)
+		}
+		return nil
+	})
+}
+
+func decodeRecognitionOfWar(b []byte, rw *gamelogic.RecognitionOfWar) error {
+	*rw = gamelogic.RecognitionOfWar{}
+	return walk(b, func(f field) error {
+		switch f.num {
+		case 1:
+			return decodePlayer(f.bytes, &rw.Attacker)
+		case 2:
+			return decodePlayer(f.bytes, &rw.Defender)
+		case 3:
+			rw.Location = gamelogic.Location(f.bytes)
+		}
+		return nil
+	})
+}
+
+// decodeInts reads one field of a repeated int64, packed or not.
+func decodeInts(f field, ids []int) ([]int, error) {
+	if f.typ == protowire.VarintType {
+		return append(ids, int(int64(f.varint))), nil
+	}
+	b := f.bytes
+	for len(b) > 0 {
+		v, n := protowire.ConsumeVarint(b)
+		if n < 0 {
+			return ids, protowire.ParseError(n)
+		}
+		ids = append(ids, int(int64(v)))
+		b = b[n:]
+	}
+	return ids, nil
+}
+
+func decodeWarResolved(b []byte, wr *gamelogic.WarResolved) error {
+	*wr = gamelogic.WarResolved{}
+	return walk(b, func(f field) error {
+		switch f.num {
+		case 1:
+			wr.Attacker = string(f.bytes)
+		case 2:
+			wr.Defender = string(f.bytes)
+		case 3:
+			wr.Location = gamelogic.Location(f.bytes)
+		case 4:
+			wr.Winner = string(f.bytes)
+		case 5:
+			wr.Loser = string(f.bytes)
+		case 6:
+			var name string
+			var ids []int
+			err := walk(f.bytes, func(f field) error {
+				switch f.num {
+				case 1:
+					name = string(f.bytes)
+				case 2:
+					return walk(f.bytes, func(f field) (err error) {
+						if f.num == 1 {
+							ids, err = decodeInts(f, ids)
+						}
+						return err
+					})
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if wr.Casualties == nil {
+				wr.Casualties = map[string][]int{}
+			}
+			wr.Casualties[name] = ids
+		}
+		return nil
+	})
+}
+
+func decodeIntent(b []byte, in *gamelogic.Intent) error {
+	*in = gamelogic.Intent{}
+	return walk(b, func(f field) (err error) {
+		switch f.num {
+		case 1:
+			in.Username = string(f.bytes)
+		case 2:
+			in.Kind = gamelogic.IntentKind(f.bytes)
+		case 3:
+			in.Location = gamelogic.Location(f.bytes)
+		case 4:
+			in.Rank = gamelogic.UnitRank(f.bytes)
+		case 5:
+			in.UnitIDs, err = decodeInts(f, in.UnitIDs)
+		}
+		return err
+	})
+}
+
+func decodeStateDelta(b []byte, d *gamelogic.StateDelta) error {
+	*d = gamelogic.StateDelta{}
+	return walk(b, func(f field) (err error) {
+		switch f.num {
+		case 1:
+			d.Username = string(f.bytes)
+		case 2:
+			d.Kind = gamelogic.IntentKind(f.bytes)
+		case 3:
+			d.Snapshot = f.varint != 0
+		case 4:
+			var u gamelogic.Unit
+			err = decodeUnit(f.bytes, &u)
+			d.Units = append(d.Units, u)
+		case 5:
+			d.Removed, err = decodeInts(f, d.Removed)
+		case 6:
+			d.Rejected = string(f.bytes)
+		}
+		return err
+	})
+}
+
+func decodePlayingState(b []byte, ps *routing.PlayingState) error {
+	*ps = routing.PlayingState{}
+	return walk(b, func(f field) error {
+		if f.num == 1 {
+			ps.IsPaused = f.varint != 0
+		}
+		return nil
+	})
+}
+
+func decodeTimestamp(b []byte) (time.Time, error) {
+	var secs, nanos int64
+	err := walk(b, func(f field) error {
+		switch f.num {
+		case 1:
+			secs = int64(f.varint)
+		case 2:
+			nanos = int64(int32(f.varint))
+		}
+		return nil
+	})
+	return time.Unix(secs, nanos), err
+}
+
+func decodeGameLog(b []byte, lg *routing.GameLog) error {
+	*lg = routing.GameLog{}
+	return walk(b, func(f field) error {
+		switch f.num {
+		case 1:
+			t, err := decodeTimestamp(f.bytes)
+			lg.CurrentTime = t
+			return err
+		case 2:
+			lg.Message = string(f.bytes)
+		case 3:
+			lg.Username = string(f.bytes)
+		}
+		return nil
+	})
+}
+
+func decodeModeration(b []byte, m *routing.Moderation) error {
+	*m = routing.Moderation{}
+	return walk(b, func(f field) (err error) {
+		switch f.num {
+		case 1:
+			m.Username = string(f.bytes)
+		case 2:
+			m.Reason = string(f.bytes)
+		case 3:
+			m.Dropped = int(int64(f.varint))
+		case 4:
+			m.Since, err = decodeTimestamp(f.bytes)
+		case 5:
+			m.Time, err = decodeTimestamp(f.bytes)
+		case 6:
+			m.Strikes = int(int64(f.varint))
+		}
+		return err
+	})
+}
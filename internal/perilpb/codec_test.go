@@ -0,0 +1,226 @@
+package perilpb
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tdabry/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/tdabry/learn-pub-sub-starter/internal/routing"
+)
+
+// roundTrip marshals in and unmarshals the result into a fresh T.
+func roundTrip[T any](t *testing.T, in T) T {
+	t.Helper()
+	data, err := Codec{}.Marshal(in)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var out T
+	if err := (Codec{}).Unmarshal(data, &out); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	// Pointers marshal the same as values.
+	viaPtr, err := Codec{}.Marshal(&in)
+	if err != nil || string(viaPtr) != string(data) {
+		t.Errorf("marshal via pointer: %x, %v; want %x", viaPtr, err, data)
+	}
+	return out
+}
+
+var (
+	bobUnits = map[int]gamelogic.Unit{
+		1: {ID: 1, Rank: gamelogic.RankInfantry, Location: "europe"},
+		7: {ID: 7, Rank: gamelogic.RankArtillery, Location: "asia"},
+	}
+	bob   = gamelogic.Player{Username: "bob", Units: bobUnits}
+	alice = gamelogic.Player{Username: "alice", Units: map[int]gamelogic.Unit{
+		3: {ID: 3, Rank: gamelogic.RankCavalry, Location: "asia"},
+	}}
+	noUnits = map[int]gamelogic.Unit{}
+)
+
+func TestArmyMoveRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		in   gamelogic.ArmyMove
+		// want is in as it decodes: empty units are empty, not nil.
+		want gamelogic.ArmyMove
+	}{
+		{
+			name: "zero",
+			want: gamelogic.ArmyMove{Player: gamelogic.Player{Units: noUnits}, Units: []gamelogic.Unit{}},
+		},
+		{
+			name: "move",
+			in:   gamelogic.ArmyMove{Player: bob, Units: []gamelogic.Unit{bobUnits[7], bobUnits[1]}, ToLocation: "asia"},
+			want: gamelogic.ArmyMove{Player: bob, Units: []gamelogic.Unit{bobUnits[7], bobUnits[1]}, ToLocation: "asia"},
+		},
+		{
+			name: "zero unit id",
+			in:   gamelogic.ArmyMove{Player: gamelogic.Player{Username: "carol", Units: map[int]gamelogic.Unit{0: {Rank: gamelogic.RankInfantry}}}},
+			want: gamelogic.ArmyMove{Player: gamelogic.Player{Username: "carol", Units: map[int]gamelogic.Unit{0: {Rank: gamelogic.RankInfantry}}}, Units: []gamelogic.Unit{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := roundTrip(t, tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecognitionOfWarRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		in   gamelogic.RecognitionOfWar
+		want gamelogic.RecognitionOfWar
+	}{
+		{
+			name: "zero",
+			want: gamelogic.RecognitionOfWar{Attacker: gamelogic.Player{Units: noUnits}, Defender: gamelogic.Player{Units: noUnits}},
+		},
+		{
+			name: "war",
+			in:   gamelogic.RecognitionOfWar{Attacker: bob, Defender: alice, Location: "asia"},
+			want: gamelogic.RecognitionOfWar{Attacker: bob, Defender: alice, Location: "asia"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := roundTrip(t, tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWarResolvedRoundTrip(t *testing.T) {
+	tests := []gamelogic.WarResolved{
+		{},
+		{Attacker: "bob", Defender: "alice", Location: "asia", Winner: "bob", Loser: "alice",
+			Casualties: map[string][]int{"alice": {3}}},
+		{Attacker: "bob", Defender: "alice", Location: "asia",
+			Casualties: map[string][]int{"alice": {3, 0}, "bob": {7}}},
+	}
+	for _, wr := range tests {
+		if got := roundTrip(t, wr); !reflect.DeepEqual(got, wr) {
+			t.Errorf("got %+v, want %+v", got, wr)
+		}
+	}
+}
+
+func TestIntentRoundTrip(t *testing.T) {
+	tests := []gamelogic.Intent{
+		{},
+		{Username: "bob", Kind: gamelogic.IntentJoin},
+		{Username: "bob", Kind: gamelogic.IntentSpawn, Location: "europe", Rank: gamelogic.RankCavalry},
+		{Username: "bob", Kind: gamelogic.IntentMove, Location: "asia", UnitIDs: []int{7, 0, 1, 300}},
+		{Username: "bob", Kind: gamelogic.IntentResume},
+	}
+	for _, in := range tests {
+		if got := roundTrip(t, in); !reflect.DeepEqual(got, in) {
+			t.Errorf("got %+v, want %+v", got, in)
+		}
+	}
+}
+
+func TestStateDeltaRoundTrip(t *testing.T) {
+	tests := []gamelogic.StateDelta{
+		{},
+		{Username: "bob", Kind: gamelogic.IntentJoin, Snapshot: true},
+		{Username: "bob", Kind: gamelogic.IntentSpawn, Units: []gamelogic.Unit{bobUnits[7]}},
+		{Username: "bob", Kind: gamelogic.IntentMove, Units: []gamelogic.Unit{bobUnits[1], bobUnits[7]}, Removed: []int{2, 0}},
+		{Username: "bob", Kind: gamelogic.IntentMove, Rejected: "the game is paused"},
+	}
+	for _, d := range tests {
+		if got := roundTrip(t, d); !reflect.DeepEqual(got, d) {
+			t.Errorf("got %+v, want %+v", got, d)
+		}
+	}
+}
+
+// Repeated int64 fields decode whether or not the sender packed them.
+func TestUnpackedInts(t *testing.T) {
+	data := []byte{5<<3 | 0, 3, 5<<3 | 0, 4}
+	var in gamelogic.Intent
+	if err := (Codec{}).Unmarshal(data, &in); err != nil || !reflect.DeepEqual(in.UnitIDs, []int{3, 4}) {
+		t.Errorf("got %v, %v", in.UnitIDs, err)
+	}
+}
+
+func TestPlayingStateRoundTrip(t *testing.T) {
+	for _, in := range []routing.PlayingState{{}, {IsPaused: true}} {
+		if got := roundTrip(t, in); got != in {
+			t.Errorf("got %+v, want %+v", got, in)
+		}
+	}
+}
+
+func TestGameLogRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		in   routing.GameLog
+	}{
+		{"zero", routing.GameLog{}},
+		{"now", routing.GameLog{CurrentTime: time.Now(), Message: "bob won a war", Username: "bob"}},
+		{"nanoseconds", routing.GameLog{CurrentTime: time.Date(2024, 2, 29, 23, 59, 59, 999999999, time.UTC), Message: "x"}},
+		{"before 1970", routing.GameLog{CurrentTime: time.Date(1969, 7, 20, 20, 17, 40, 5, time.UTC), Username: "armstrong"}},
+		{"epoch", routing.GameLog{CurrentTime: time.Unix(0, 0), Message: "epoch"}},
+		{"unicode", routing.GameLog{Message: "héllo, 世界", Username: "zoë"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := roundTrip(t, tt.in)
+			if !got.CurrentTime.Equal(tt.in.CurrentTime) || got.CurrentTime.IsZero() != tt.in.CurrentTime.IsZero() {
+				t.Errorf("time %v, want %v", got.CurrentTime, tt.in.CurrentTime)
+			}
+			if got.Message != tt.in.Message || got.Username != tt.in.Username {
+				t.Errorf("got %+v, want %+v", got, tt.in)
+			}
+		})
+	}
+}
+
+func TestModerationRoundTrip(t *testing.T) {
+	since := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []routing.Moderation{
+		{},
+		{Username: "mallory", Reason: "over quota", Dropped: 42, Since: since, Time: since.Add(time.Minute), Strikes: 3},
+	}
+	for _, m := range tests {
+		got := roundTrip(t, m)
+		if !got.Since.Equal(m.Since) || !got.Time.Equal(m.Time) {
+			t.Errorf("times %v, %v; want %v, %v", got.Since, got.Time, m.Since, m.Time)
+		}
+		got.Since, got.Time = m.Since, m.Time
+		if got != m {
+			t.Errorf("got %+v, want %+v", got, m)
+		}
+	}
+}
+
+func TestUnknownType(t *testing.T) {
+	if _, err := (Codec{}).Marshal("not a peril message"); err == nil {
+		t.Error("marshal of a string succeeded")
+	}
+	var s string
+	if err := (Codec{}).Unmarshal(nil, &s); err == nil {
+		t.Error("unmarshal into a string succeeded")
+	}
+}
+
+func TestUnknownFieldsIgnored(t *testing.T) {
+	data, err := Codec{}.Marshal(routing.PlayingState{IsPaused: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Field 15, varint 1, and field 14, fixed64: what a newer schema
+	// might add.
+	data = append(data, 15<<3|0, 1, 14<<3|1, 1, 2, 3, 4, 5, 6, 7, 8)
+	var ps routing.PlayingState
+	if err := (Codec{}).Unmarshal(data, &ps); err != nil || !ps.IsPaused {
+		t.Errorf("got %+v, %v", ps, err)
+	}
+}
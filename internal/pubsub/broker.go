@@ -0,0 +1,120 @@
+package pubsub
+
+import (
+	"context"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Publisher is anything that can publish a message to an exchange.
+// *amqp.Channel satisfies it.
+type Publisher interface {
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// Subscriber is the consuming half of a channel.
+type Subscriber interface {
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	Cancel(consumer string, noWait bool) error
+}
+
+// Channel is the subset of *amqp.Channel used by the game.
+type Channel interface {
+	Publisher
+	Subscriber
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	Close() error
+}
+
+// Broker is a connection to a message broker that hands out channels.
+// NotifyClose behaves like amqp.Connection.NotifyClose: the receiver gets
+// an error if the connection is lost and is closed on shutdown.
+type Broker interface {
+	Channel() (Channel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+var _ Channel = (*amqp.Channel)(nil)
+
+type amqpBroker struct {
+	conn *amqp.Connection
+}
+
+// NewAMQPBroker wraps an open RabbitMQ connection.
+func NewAMQPBroker(conn *amqp.Connection) Broker {
+	return &amqpBroker{conn: conn}
+}
+
+// Dial connects to RabbitMQ at url.
+func Dial(url string) (Broker, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return NewAMQPBroker(conn), nil
+}
+
+// DialConfig is Dial with TLS, SASL and tuning settings. Like amqp.Dial it
+// defaults to a 10s heartbeat, and for amqps to checking the certificate
+// against the URL's host.
+func DialConfig(url string, cfg amqp.Config) (Broker, error) {
+	if cfg.Heartbeat == 0 {
+		cfg.Heartbeat = 10 * time.Second
+	}
+	if cfg.Locale == "" {
+		cfg.Locale = "en_US"
+	}
+	conn, err := amqp.DialConfig(url, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewAMQPBroker(conn), nil
+}
+
+func (b *amqpBroker) Channel() (Channel, error) {
+	ch, err := b.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (b *amqpBroker) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	return b.conn.NotifyClose(receiver)
+}
+
+func (b *amqpBroker) Close() error {
+	return b.conn.Close()
+}
+
+// MemoryURL selects the in-process broker instead of RabbitMQ.
+const MemoryURL = "memory://"
+
+// Connect dials RabbitMQ at url, or starts an empty MemoryBroker when url
+// is MemoryURL. Either way the Peril topology still has to be declared.
+func Connect(url string) (Broker, error) {
+	if url != MemoryURL {
+		return Dial(url)
+	}
+	return NewMemoryBroker(), nil
+}
+
+// ConnectConfig is Connect using DialConfig. The in-process broker ignores
+// cfg.
+func ConnectConfig(url string, cfg amqp.Config) (Broker, error) {
+	if url != MemoryURL {
+		return DialConfig(url, cfg)
+	}
+	return NewMemoryBroker(), nil
+}
@@ -0,0 +1,102 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/tdabry/learn-pub-sub-starter/internal/perilpb"
+)
+
+const (
+	ContentTypeJSON  = "application/json"
+	ContentTypeGob   = "application/gob"
+	ContentTypeProto = perilpb.ContentType
+)
+
+// Codec turns values into message bodies and back. ContentType is what
+// publishers put on the message and what subscribers look up to decode it.
+type Codec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+type JSONCodec struct{}
+
+func (JSONCodec) ContentType() string                { return ContentTypeJSON }
+func (JSONCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (JSONCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type GobCodec struct{}
+
+func (GobCodec) ContentType() string { return ContentTypeGob }
+
+func (GobCodec) Marshal(v any) ([]byte, error) {
+	var network bytes.Buffer
+	if err := gob.NewEncoder(&network).Encode(v); err != nil {
+		return nil, err
+	}
+	return network.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+var (
+	JSON Codec = JSONCodec{}
+	Gob  Codec = GobCodec{}
+	// Proto only handles the Peril message types; see perilpb.
+	Proto Codec = perilpb.Codec{}
+)
+
+var codecs = struct {
+	mu     sync.RWMutex
+	byType map[string]Codec
+}{byType: map[string]Codec{}}
+
+func init() {
+	RegisterCodec(JSON)
+	RegisterCodec(Gob)
+	RegisterCodec(Proto)
+}
+
+// RegisterCodec makes c available to subscribers for its content type,
+// replacing any codec already registered for it.
+func RegisterCodec(c Codec) {
+	codecs.mu.Lock()
+	defer codecs.mu.Unlock()
+	codecs.byType[c.ContentType()] = c
+}
+
+// CodecFor looks up the codec for a content type, ignoring parameters such
+// as charset.
+func CodecFor(contentType string) (Codec, bool) {
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mt
+	}
+	codecs.mu.RLock()
+	defer codecs.mu.RUnlock()
+	c, ok := codecs.byType[contentType]
+	return c, ok
+}
+
+// decode picks the codec from the delivery's content type. fallback is
+// only used for deliveries that carry no content type at all.
+func decode[T any](d amqp.Delivery, fallback Codec) (T, error) {
+	var decoded T
+	c, ok := CodecFor(d.ContentType)
+	if !ok {
+		if d.ContentType != "" || fallback == nil {
+			return decoded, fmt.Errorf("no codec for content type %q", d.ContentType)
+		}
+		c = fallback
+	}
+	err := c.Unmarshal(d.Body, &decoded)
+	return decoded, err
+}
@@ -0,0 +1,110 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/tdabry/learn-pub-sub-starter/internal/routing"
+)
+
+func TestCodecFor(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        Codec
+	}{
+		{ContentTypeJSON, JSON},
+		{"application/json; charset=utf-8", JSON},
+		{ContentTypeGob, Gob},
+		{ContentTypeProto, Proto},
+		{"text/plain", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		c, ok := CodecFor(tt.contentType)
+		if ok != (tt.want != nil) || c != tt.want {
+			t.Errorf("CodecFor(%q) = %v, %v; want %v", tt.contentType, c, ok, tt.want)
+		}
+	}
+}
+
+func TestDecodeFallback(t *testing.T) {
+	d := amqp.Delivery{Body: []byte(`"hi"`)}
+	if got, err := decode[string](d, JSON); err != nil || got != "hi" {
+		t.Errorf("with a default codec: %q, %v", got, err)
+	}
+	if _, err := decode[string](d, nil); err == nil {
+		t.Error("decoded a delivery without content type or default codec")
+	}
+	d.ContentType = "text/plain"
+	if _, err := decode[string](d, JSON); err == nil {
+		t.Error("default codec used for an unknown content type")
+	}
+}
+
+// TestSubscribeDecodesByContentType sends the same game log in every
+// registered encoding to one subscriber, plus one it cannot decode, which
+// must be dead-lettered once rather than requeued.
+func TestSubscribeDecodesByContentType(t *testing.T) {
+	b := NewMemoryBroker()
+	ch := deadLetterSetup(t, b)
+	if err := ch.ExchangeDeclare("ex", amqp.ExchangeTopic, false, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan Message[routing.GameLog], 8)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := SubscribeMessage(ctx, b, "ex", "logs", "logs.*", Durable,
+		func(msg Message[routing.GameLog]) Acktype {
+			got <- msg
+			return Ack
+		}, WithQueueOptions(QueueOptions{DeadLetterExchange: "dlx"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lg := routing.GameLog{CurrentTime: time.Unix(1700000000, 0).UTC(), Message: "hello", Username: "bob"}
+	for _, c := range []Codec{JSON, Gob, Proto} {
+		if err := Publish(ch, c, "ex", "logs.bob", lg); err != nil {
+			t.Fatalf("%s: %v", c.ContentType(), err)
+		}
+	}
+	if err := ch.PublishWithContext(context.Background(), "ex", "logs.bob", false, false,
+		amqp.Publishing{ContentType: "text/plain", Body: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{ContentTypeJSON, ContentTypeGob, ContentTypeProto} {
+		select {
+		case msg := <-got:
+			if msg.ContentType != want {
+				t.Errorf("got %s, want %s", msg.ContentType, want)
+			}
+			if !msg.Body.CurrentTime.Equal(lg.CurrentTime) || msg.Body.Message != lg.Message || msg.Body.Username != lg.Username {
+				t.Errorf("%s decoded %+v, want %+v", msg.ContentType, msg.Body, lg)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s not delivered", want)
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	var dead []string
+	for len(dead) == 0 && time.Now().Before(deadline) {
+		dead = drain(t, ch, "dlq")
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(dead) != 1 || dead[0] != "hello" {
+		t.Fatalf("dead-lettered %q, want the undecodable message", dead)
+	}
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case msg := <-got:
+		t.Errorf("handler got %+v", msg)
+	default:
+	}
+	if left := ready(t, ch, "logs"); left != 0 {
+		t.Errorf("%d messages still queued", left)
+	}
+}
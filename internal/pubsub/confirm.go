@@ -0,0 +1,309 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	ErrNacked     = errors.New("pubsub: broker nacked message")
+	ErrUnroutable = errors.New("pubsub: message unroutable")
+)
+
+// ReturnedError is reported when the broker hands back a mandatory
+// message because no queue was bound for it. It matches ErrUnroutable
+// with errors.Is.
+type ReturnedError struct {
+	Exchange   string
+	RoutingKey string
+	ReplyCode  uint16
+	ReplyText  string
+}
+
+func (e *ReturnedError) Error() string {
+	return fmt.Sprintf("pubsub: message to %s/%s returned: %d %s",
+		e.Exchange, e.RoutingKey, e.ReplyCode, e.ReplyText)
+}
+
+func (e *ReturnedError) Unwrap() error {
+	return ErrUnroutable
+}
+
+// Confirmation is the pending outcome of one confirmed publish.
+type Confirmation struct {
+	id   string
+	done chan struct{}
+	err  error
+}
+
+// Done is closed once the broker has settled the message.
+func (c *Confirmation) Done() <-chan struct{} {
+	return c.done
+}
+
+// Wait blocks until the broker acks, nacks or returns the message.
+func (c *Confirmation) Wait(ctx context.Context) error {
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Confirmation) settle(err error) {
+	c.err = err
+	close(c.done)
+}
+
+// ConfirmedPublisher publishes on its own channel in confirm mode with
+// mandatory set, so every message is either acked by the broker or comes
+// back as an error. The channel is reopened from the broker on the next
+// publish if it closes.
+type ConfirmedPublisher struct {
+	conn Broker
+
+	mu       sync.Mutex
+	ch       Channel
+	seq      uint64
+	pending  map[uint64]*Confirmation
+	byID     map[string]uint64
+	returned map[uint64]amqp.Return
+	closed   bool
+}
+
+func NewConfirmedPublisher(conn Broker) (*ConfirmedPublisher, error) {
+	p := &ConfirmedPublisher{conn: conn}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.channelLocked(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// PublishWithContext publishes msg and waits for the broker to confirm it.
+// The mandatory and immediate arguments are ignored: messages are always
+// published mandatory.
+func (p *ConfirmedPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c, err := p.PublishDeferred(ctx, exchange, key, msg)
+	if err != nil {
+		return err
+	}
+	return c.Wait(ctx)
+}
+
+// PublishDeferred publishes msg and returns without waiting for the
+// broker's confirm.
+func (p *ConfirmedPublisher) PublishDeferred(ctx context.Context, exchange, key string, msg amqp.Publishing) (*Confirmation, error) {
+	if msg.MessageId == "" {
+		msg.MessageId = newMessageID()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, err := p.publishLocked(ctx, exchange, key, msg)
+	if errors.Is(err, amqp.ErrClosed) {
+		// The channel died since the last publish; try once on a new one.
+		c, err = p.publishLocked(ctx, exchange, key, msg)
+	}
+	return c, err
+}
+
+func (p *ConfirmedPublisher) publishLocked(ctx context.Context, exchange, key string, msg amqp.Publishing) (*Confirmation, error) {
+	ch, err := p.channelLocked()
+	if err != nil {
+		return nil, err
+	}
+	p.seq++
+	tag := p.seq
+	c := &Confirmation{id: msg.MessageId, done: make(chan struct{})}
+	p.pending[tag] = c
+	p.byID[c.id] = tag
+	if err := ch.PublishWithContext(ctx, exchange, key, true, false, msg); err != nil {
+		delete(p.pending, tag)
+		delete(p.byID, c.id)
+		p.dropLocked(ch)
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the publisher's channel. Publishes still waiting for a
+// confirm fail with amqp.ErrClosed.
+func (p *ConfirmedPublisher) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	ch := p.ch
+	p.mu.Unlock()
+	if ch == nil {
+		return nil
+	}
+	return ch.Close()
+}
+
+func (p *ConfirmedPublisher) channelLocked() (Channel, error) {
+	if p.closed {
+		return nil, amqp.ErrClosed
+	}
+	if p.ch != nil {
+		return p.ch, nil
+	}
+	ch, err := p.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	// Unbuffered listeners keep a return ahead of the ack for the same
+	// message, which is the order the broker sends them in.
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation))
+	returns := ch.NotifyReturn(make(chan amqp.Return))
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	p.ch = ch
+	p.seq = 0
+	p.pending = map[uint64]*Confirmation{}
+	p.byID = map[string]uint64{}
+	p.returned = map[uint64]amqp.Return{}
+	go p.listen(ch, confirms, returns)
+	return ch, nil
+}
+
+func (p *ConfirmedPublisher) listen(ch Channel, confirms chan amqp.Confirmation, returns chan amqp.Return) {
+	for {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			p.mu.Lock()
+			if tag, ok := p.byID[r.MessageId]; ok && p.ch == ch {
+				p.returned[tag] = r
+			}
+			p.mu.Unlock()
+		case c, ok := <-confirms:
+			if !ok {
+				p.channelClosed(ch)
+				return
+			}
+			p.confirm(ch, c)
+		}
+	}
+}
+
+func (p *ConfirmedPublisher) confirm(ch Channel, conf amqp.Confirmation) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ch != ch {
+		return
+	}
+	c, ok := p.pending[conf.DeliveryTag]
+	if !ok {
+		return
+	}
+	delete(p.pending, conf.DeliveryTag)
+	delete(p.byID, c.id)
+	r, returned := p.returned[conf.DeliveryTag]
+	delete(p.returned, conf.DeliveryTag)
+	switch {
+	case returned:
+		c.settle(&ReturnedError{
+			Exchange:   r.Exchange,
+			RoutingKey: r.RoutingKey,
+			ReplyCode:  r.ReplyCode,
+			ReplyText:  r.ReplyText,
+		})
+	case !conf.Ack:
+		c.settle(ErrNacked)
+	default:
+		c.settle(nil)
+	}
+}
+
+// channelClosed fails everything still waiting on ch; the broker will
+// never confirm it.
+func (p *ConfirmedPublisher) channelClosed(ch Channel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dropLocked(ch)
+}
+
+func (p *ConfirmedPublisher) dropLocked(ch Channel) {
+	if p.ch != ch {
+		return
+	}
+	for _, c := range p.pending {
+		c.settle(amqp.ErrClosed)
+	}
+	// Closing waits on the broker, which may be blocked handing listen a
+	// confirm while we hold the lock.
+	go ch.Close()
+	p.ch = nil
+	p.pending = nil
+	p.byID = nil
+	p.returned = nil
+}
+
+// Batch keeps several confirmed publishes in flight and waits for all of
+// them at once. It satisfies Publisher, so PublishJSON and PublishGob can
+// add to it.
+type Batch struct {
+	p        *ConfirmedPublisher
+	mu       sync.Mutex
+	confirms []*Confirmation
+	errs     []error
+	n        int
+}
+
+func (p *ConfirmedPublisher) Batch() *Batch {
+	return &Batch{p: p}
+}
+
+func (b *Batch) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c, err := b.p.PublishDeferred(ctx, exchange, key, msg)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.n++
+	if err != nil {
+		b.errs = append(b.errs, err)
+		return err
+	}
+	b.confirms = append(b.confirms, c)
+	return nil
+}
+
+// Len is the number of messages published through the batch so far.
+func (b *Batch) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.n
+}
+
+// Wait blocks until every message in the batch is settled and returns the
+// failures joined together, or nil if all were confirmed.
+func (b *Batch) Wait(ctx context.Context) error {
+	b.mu.Lock()
+	confirms := b.confirms
+	errs := append([]error(nil), b.errs...)
+	b.confirms, b.errs = nil, nil
+	b.mu.Unlock()
+	for _, c := range confirms {
+		if err := c.Wait(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func newMessageID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,82 @@
+package pubsub
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DeadLetter is a delivery from the dead letter queue with its x-death
+// history unpacked.
+type DeadLetter struct {
+	amqp.Delivery
+	// Reason and Queue describe the most recent death: why the message
+	// was dead-lettered (rejected, expired, maxlen) and from which queue.
+	Reason string
+	Queue  string
+	Count  int
+	Time   time.Time
+	// OriginalExchange and OriginalRoutingKey are where the message was
+	// first published, which is where Replay sends it.
+	OriginalExchange   string
+	OriginalRoutingKey string
+}
+
+func ParseDeadLetter(d amqp.Delivery) DeadLetter {
+	dl := DeadLetter{Delivery: d}
+	deaths, _ := d.Headers["x-death"].([]interface{})
+	if len(deaths) > 0 {
+		if last, ok := deaths[0].(amqp.Table); ok {
+			dl.Reason, _ = last["reason"].(string)
+			dl.Queue, _ = last["queue"].(string)
+			dl.Count, _ = headerInt(last, "count")
+			dl.Time, _ = last["time"].(time.Time)
+		}
+		if first, ok := deaths[len(deaths)-1].(amqp.Table); ok {
+			dl.OriginalExchange, _ = first["exchange"].(string)
+			if keys, ok := first["routing-keys"].([]interface{}); ok && len(keys) > 0 {
+				dl.OriginalRoutingKey, _ = keys[0].(string)
+			}
+		}
+	}
+	if ex, ok := d.Headers[HeaderOriginalExchange].(string); ok {
+		dl.OriginalExchange = ex
+		dl.OriginalRoutingKey, _ = d.Headers[HeaderOriginalRoutingKey].(string)
+	}
+	return dl
+}
+
+// Replay publishes the message again to its original exchange and key,
+// without the dead-lettering and retry headers, so it starts over as if
+// it had just been sent. It does not settle the dead letter itself.
+func (dl DeadLetter) Replay(ctx context.Context, pub Publisher) error {
+	headers := amqp.Table{}
+	for k, v := range dl.Headers {
+		if k == "x-death" || strings.HasPrefix(k, "x-first-death-") || strings.HasPrefix(k, "x-last-death-") {
+			continue
+		}
+		switch k {
+		case HeaderAttempts, HeaderOriginalExchange, HeaderOriginalRoutingKey:
+			continue
+		}
+		headers[k] = v
+	}
+	d := dl.Delivery
+	return pub.PublishWithContext(ctx, dl.OriginalExchange, dl.OriginalRoutingKey, false, false, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		UserId:          d.UserId,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	})
+}
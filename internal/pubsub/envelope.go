@@ -0,0 +1,150 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// SchemaVersion is stamped on every message published through Publish.
+// Bump it when a message type changes shape incompatibly.
+const SchemaVersion = 1
+
+const HeaderSchemaVersion = "x-peril-schema-version"
+
+// AppID identifies this process on outgoing messages. It defaults to the
+// binary name.
+var AppID = filepath.Base(os.Args[0])
+
+// Metadata is the envelope around a message: the AMQP properties Publish
+// fills in plus where the delivery came from.
+type Metadata struct {
+	MessageID     string
+	CorrelationID string
+	ContentType   string
+	Type          string
+	AppID         string
+	Timestamp     time.Time
+	SchemaVersion int
+	// Attempts is how many handlers have already asked for a retry.
+	Attempts    int
+	Exchange    string
+	RoutingKey  string
+	Redelivered bool
+	Headers     amqp.Table
+	// Raw is the body as delivered, before decoding.
+	Raw []byte
+}
+
+// Message is a decoded delivery together with its envelope.
+type Message[T any] struct {
+	Metadata
+	Body T
+
+	ctx context.Context
+}
+
+// Context is cancelled when a Timeout middleware gives up on the handler.
+func (m Message[T]) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+// TraceID is the id to correlate follow-up messages with: the incoming
+// correlation id if there is one, otherwise this message's own id.
+func (m Metadata) TraceID() string {
+	if m.CorrelationID != "" {
+		return m.CorrelationID
+	}
+	return m.MessageID
+}
+
+type PublishOption func(*amqp.Publishing)
+
+// WithCorrelationID links the message to the one that caused it.
+func WithCorrelationID(id string) PublishOption {
+	return func(p *amqp.Publishing) {
+		p.CorrelationId = id
+	}
+}
+
+func WithMessageID(id string) PublishOption {
+	return func(p *amqp.Publishing) {
+		p.MessageId = id
+	}
+}
+
+func WithHeader(key string, value any) PublishOption {
+	return func(p *amqp.Publishing) {
+		p.Headers[key] = value
+	}
+}
+
+func newPublishing(codec Codec, val any, opts []PublishOption) (amqp.Publishing, error) {
+	body, err := codec.Marshal(val)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+	msg := amqp.Publishing{
+		ContentType: codec.ContentType(),
+		Body:        body,
+		MessageId:   newMessageID(),
+		Timestamp:   time.Now().UTC(),
+		AppId:       AppID,
+		Type:        fmt.Sprintf("%T", val),
+		Headers:     amqp.Table{HeaderSchemaVersion: int32(SchemaVersion)},
+	}
+	for _, opt := range opts {
+		opt(&msg)
+	}
+	return msg, nil
+}
+
+func metadataFrom(d amqp.Delivery) Metadata {
+	md := Metadata{
+		MessageID:     d.MessageId,
+		CorrelationID: d.CorrelationId,
+		ContentType:   d.ContentType,
+		Type:          d.Type,
+		AppID:         d.AppId,
+		Timestamp:     d.Timestamp,
+		Exchange:      d.Exchange,
+		RoutingKey:    d.RoutingKey,
+		Redelivered:   d.Redelivered,
+		Headers:       d.Headers,
+		Raw:           d.Body,
+	}
+	md.SchemaVersion, _ = headerInt(d.Headers, HeaderSchemaVersion)
+	md.Attempts, _ = headerInt(d.Headers, HeaderAttempts)
+	return md
+}
+
+// headerInt reads an integer header whatever width the broker or the
+// publisher's client library gave it.
+func headerInt(h amqp.Table, key string) (int, bool) {
+	switch v := h[key].(type) {
+	case int:
+		return v, true
+	case int8:
+		return int(v), true
+	case int16:
+		return int(v), true
+	case int32:
+		return int(v), true
+	case int64:
+		return int(v), true
+	case uint8:
+		return int(v), true
+	case uint16:
+		return int(v), true
+	case uint32:
+		return int(v), true
+	}
+	return 0, false
+}
@@ -0,0 +1,1107 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/tdabry/learn-pub-sub-starter/internal/routing"
+)
+
+// MemoryBroker is an in-process stand-in for RabbitMQ. It routes through
+// direct, topic and fanout exchanges (plus the default exchange), keeps
+// durable and transient queues, tracks manual acks with requeue and
+// dead-letters rejected and expired messages through x-dead-letter-exchange.
+// Per-queue (x-message-ttl) and per-message (Expiration) TTLs are honoured,
+// as are x-expires, x-max-length and x-max-length-bytes with either
+// overflow policy, and x-single-active-consumer. Quorum and lazy queues
+// behave like classic ones. Policies set with SetPolicy apply to the
+// queues they match, alongside their arguments.
+//
+// A MemoryBroker is itself a Broker backed by a default connection;
+// Connect opens further connections to the same broker.
+type MemoryBroker struct {
+	*memConn
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	exchanges map[string]*memExchange
+	queues    map[string]*memQueue
+	policies  map[string]Policy
+	conns     map[*memConn]struct{}
+	seq       int
+}
+
+type memExchange struct {
+	name     string
+	kind     string
+	durable  bool
+	bindings []memBinding
+}
+
+type memBinding struct {
+	queue string
+	key   string
+}
+
+type memQueue struct {
+	name       string
+	durable    bool
+	autoDelete bool
+	exclusive  bool
+	owner      *memConn
+	args       amqp.Table
+	// policy is the x- arguments of the policy that applies to the queue.
+	policy   amqp.Table
+	messages []*memMessage
+	bytes    int
+	// used counts uses of the queue so an x-expires timer can tell
+	// whether it has been used since it was set.
+	used      int
+	consumers []*memConsumer
+	deleted   bool
+}
+
+type memMessage struct {
+	exchange    string
+	key         string
+	pub         amqp.Publishing
+	redelivered bool
+	expires     time.Time
+}
+
+type memConn struct {
+	b        *MemoryBroker
+	channels map[*memChannel]struct{}
+	closed   bool
+	notify   []chan *amqp.Error
+}
+
+type memChannel struct {
+	conn      *memConn
+	closed    bool
+	prefetch  int
+	consumers map[string]*memConsumer
+	unacked   map[uint64]memUnacked
+	nextTag   uint64
+
+	confirming bool
+	publishSeq uint64
+	notices    []memNotice
+	notifying  bool
+	confirms   []chan amqp.Confirmation
+	returns    []chan amqp.Return
+}
+
+// memNotice is a publisher confirm or basic.return waiting to be handed to
+// the channel's listeners, in the order the broker produced them.
+type memNotice struct {
+	confirm *amqp.Confirmation
+	ret     *amqp.Return
+}
+
+type memUnacked struct {
+	queue *memQueue
+	msg   *memMessage
+}
+
+type memConsumer struct {
+	tag        string
+	ch         *memChannel
+	queue      *memQueue
+	autoAck    bool
+	deliveries chan amqp.Delivery
+	done       chan struct{}
+	cancelled  bool
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	b := &MemoryBroker{
+		exchanges: map[string]*memExchange{},
+		queues:    map[string]*memQueue{},
+		policies:  map[string]Policy{},
+		conns:     map[*memConn]struct{}{},
+	}
+	b.cond = sync.NewCond(&b.mu)
+	b.memConn = b.connect()
+	return b
+}
+
+// Connect opens another connection to the same in-memory broker.
+func (b *MemoryBroker) Connect() Broker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.connect()
+}
+
+func (b *MemoryBroker) connect() *memConn {
+	c := &memConn{b: b, channels: map[*memChannel]struct{}{}}
+	b.conns[c] = struct{}{}
+	return c
+}
+
+// Restart simulates a broker restart: every connection is dropped with
+// CONNECTION_FORCED, and only durable exchanges and queues (with their
+// messages) survive.
+func (b *MemoryBroker) Restart() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.conns {
+		c.closeLocked(&amqp.Error{Code: amqp.ConnectionForced, Reason: "broker restarted", Server: true, Recover: true})
+	}
+	for _, q := range b.queues {
+		if !q.durable {
+			b.deleteQueueLocked(q)
+		}
+	}
+	for name, ex := range b.exchanges {
+		if !ex.durable {
+			delete(b.exchanges, name)
+		}
+	}
+	b.cond.Broadcast()
+}
+
+// SetPolicy adds or replaces a policy and applies it to the queues it
+// matches. Lowering a queue's length limit drops its oldest messages.
+func (b *MemoryBroker) SetPolicy(p Policy) error {
+	if _, err := p.Definition(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.policies[p.Name] = p
+	for name, q := range b.queues {
+		q.policy = b.policyLocked(name)
+		for len(q.messages) > 0 && q.fullLocked(0) {
+			b.deadLetterLocked(q, q.popLocked(), "maxlen")
+		}
+	}
+	b.cond.Broadcast()
+	return nil
+}
+
+// Policies lists the broker's policies by name.
+func (b *MemoryBroker) Policies() ([]Policy, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	policies := make([]Policy, 0, len(b.policies))
+	for _, p := range b.policies {
+		policies = append(policies, p)
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Name < policies[j].Name })
+	return policies, nil
+}
+
+// policyLocked is the arguments of the highest priority policy matching
+// the queue name, the first by name among equals.
+func (b *MemoryBroker) policyLocked(queue string) amqp.Table {
+	var best *Policy
+	for _, p := range b.policies {
+		if ok, _ := regexp.MatchString(p.Pattern, queue); !ok {
+			continue
+		}
+		if best == nil || p.Priority > best.Priority || p.Priority == best.Priority && p.Name < best.Name {
+			best = &p
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return best.Queue.Args()
+}
+
+func (b *MemoryBroker) nextName(prefix string) string {
+	b.seq++
+	return fmt.Sprintf("%s-%d", prefix, b.seq)
+}
+
+func (c *memConn) Channel() (Channel, error) {
+	b := c.b
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	ch := &memChannel{
+		conn:      c,
+		consumers: map[string]*memConsumer{},
+		unacked:   map[uint64]memUnacked{},
+	}
+	c.channels[ch] = struct{}{}
+	return ch, nil
+}
+
+func (c *memConn) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	if c.closed {
+		close(receiver)
+		return receiver
+	}
+	c.notify = append(c.notify, receiver)
+	return receiver
+}
+
+func (c *memConn) Close() error {
+	b := c.b
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.closeLocked(nil)
+	return nil
+}
+
+func (c *memConn) closeLocked(reason *amqp.Error) {
+	if c.closed {
+		return
+	}
+	b := c.b
+	c.closed = true
+	delete(b.conns, c)
+	for ch := range c.channels {
+		ch.closeLocked()
+	}
+	for _, q := range b.queues {
+		if q.owner == c {
+			b.deleteQueueLocked(q)
+		}
+	}
+	for _, n := range c.notify {
+		if reason != nil {
+			select {
+			case n <- reason:
+			default:
+			}
+		}
+		close(n)
+	}
+	c.notify = nil
+	b.cond.Broadcast()
+}
+
+func (ch *memChannel) broker() *MemoryBroker {
+	return ch.conn.b
+}
+
+// failLocked mirrors a channel exception: the channel is closed and the
+// error is handed back to the caller.
+func (ch *memChannel) failLocked(code int, format string, args ...any) error {
+	ch.closeLocked()
+	return &amqp.Error{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+func (ch *memChannel) closeLocked() {
+	if ch.closed {
+		return
+	}
+	ch.closed = true
+	for _, c := range ch.consumers {
+		ch.broker().cancelConsumerLocked(c)
+	}
+	tags := make([]uint64, 0, len(ch.unacked))
+	for tag := range ch.unacked {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] > tags[j] })
+	for _, tag := range tags {
+		u := ch.unacked[tag]
+		u.msg.redelivered = true
+		u.queue.pushFront(u.msg)
+	}
+	ch.unacked = map[uint64]memUnacked{}
+	delete(ch.conn.channels, ch)
+	ch.broker().cond.Broadcast()
+}
+
+func (ch *memChannel) Close() error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.closeLocked()
+	return nil
+}
+
+func (ch *memChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	switch kind {
+	case amqp.ExchangeDirect, amqp.ExchangeTopic, amqp.ExchangeFanout:
+	default:
+		return ch.failLocked(amqp.NotImplemented, "exchange type %q not supported", kind)
+	}
+	if ex, ok := b.exchanges[name]; ok {
+		if ex.kind != kind || ex.durable != durable {
+			return ch.failLocked(amqp.PreconditionFailed, "inequivalent arg for exchange '%s'", name)
+		}
+		return nil
+	}
+	b.exchanges[name] = &memExchange{name: name, kind: kind, durable: durable}
+	return nil
+}
+
+func (ch *memChannel) ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if _, ok := b.exchanges[name]; !ok {
+		return ch.failLocked(amqp.NotFound, "no exchange '%s'", name)
+	}
+	return nil
+}
+
+func (ch *memChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return amqp.Queue{}, ch.failLocked(amqp.NotFound, "no queue '%s'", name)
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return amqp.Queue{}, ch.failLocked(amqp.ResourceLocked, "cannot obtain exclusive access to locked queue '%s'", name)
+	}
+	return amqp.Queue{Name: name, Messages: len(q.messages), Consumers: len(q.consumers)}, nil
+}
+
+func (ch *memChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	if name == "" {
+		name = b.nextName("amq.gen")
+	}
+	if q, ok := b.queues[name]; ok {
+		if q.exclusive && q.owner != ch.conn {
+			return amqp.Queue{}, ch.failLocked(amqp.ResourceLocked, "cannot obtain exclusive access to locked queue '%s'", name)
+		}
+		if q.durable != durable || q.autoDelete != autoDelete || q.exclusive != exclusive || !equivalentArgs(q.args, args) {
+			return amqp.Queue{}, ch.failLocked(amqp.PreconditionFailed, "inequivalent arg for queue '%s'", name)
+		}
+		b.touchLocked(q)
+		return amqp.Queue{Name: name, Messages: len(q.messages), Consumers: len(q.consumers)}, nil
+	}
+	q := &memQueue{
+		name:       name,
+		durable:    durable,
+		autoDelete: autoDelete,
+		exclusive:  exclusive,
+		args:       args,
+	}
+	if kind, _ := args["x-queue-type"].(string); kind == string(QuorumQueue) && (!durable || autoDelete || exclusive) {
+		return amqp.Queue{}, ch.failLocked(amqp.PreconditionFailed, "invalid property for quorum queue '%s'", name)
+	}
+	if exclusive {
+		q.owner = ch.conn
+	}
+	q.policy = b.policyLocked(name)
+	b.queues[name] = q
+	b.touchLocked(q)
+	return amqp.Queue{Name: name}, nil
+}
+
+func (ch *memChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if _, ok := b.queues[name]; !ok {
+		return ch.failLocked(amqp.NotFound, "no queue '%s'", name)
+	}
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return ch.failLocked(amqp.NotFound, "no exchange '%s'", exchange)
+	}
+	for _, bd := range ex.bindings {
+		if bd.queue == name && bd.key == key {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, memBinding{queue: name, key: key})
+	return nil
+}
+
+func (ch *memChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.prefetch = prefetchCount
+	b.cond.Broadcast()
+	return nil
+}
+
+func (ch *memChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	routed, rejected, err := b.routeLocked(exchange, key, msg)
+	if err != nil {
+		ch.closeLocked()
+		return err
+	}
+	if mandatory && routed == 0 {
+		ch.noticeLocked(memNotice{ret: &amqp.Return{
+			ReplyCode:       amqp.NoRoute,
+			ReplyText:       "NO_ROUTE",
+			Exchange:        exchange,
+			RoutingKey:      key,
+			ContentType:     msg.ContentType,
+			ContentEncoding: msg.ContentEncoding,
+			Headers:         msg.Headers,
+			DeliveryMode:    msg.DeliveryMode,
+			Priority:        msg.Priority,
+			CorrelationId:   msg.CorrelationId,
+			ReplyTo:         msg.ReplyTo,
+			Expiration:      msg.Expiration,
+			MessageId:       msg.MessageId,
+			Timestamp:       msg.Timestamp,
+			Type:            msg.Type,
+			UserId:          msg.UserId,
+			AppId:           msg.AppId,
+			Body:            msg.Body,
+		}})
+	}
+	if ch.confirming {
+		ch.publishSeq++
+		ch.noticeLocked(memNotice{confirm: &amqp.Confirmation{DeliveryTag: ch.publishSeq, Ack: !rejected}})
+	}
+	return nil
+}
+
+func (ch *memChannel) Confirm(noWait bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.confirming = true
+	return nil
+}
+
+func (ch *memChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		close(confirm)
+		return confirm
+	}
+	ch.confirms = append(ch.confirms, confirm)
+	ch.startNotifierLocked()
+	return confirm
+}
+
+func (ch *memChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		close(c)
+		return c
+	}
+	ch.returns = append(ch.returns, c)
+	ch.startNotifierLocked()
+	return c
+}
+
+func (ch *memChannel) noticeLocked(n memNotice) {
+	if n.confirm != nil && len(ch.confirms) == 0 || n.ret != nil && len(ch.returns) == 0 {
+		return
+	}
+	ch.notices = append(ch.notices, n)
+	ch.broker().cond.Broadcast()
+}
+
+func (ch *memChannel) startNotifierLocked() {
+	if !ch.notifying {
+		ch.notifying = true
+		go ch.notifier()
+	}
+}
+
+// notifier is the only goroutine that sends to or closes the channel's
+// confirm and return listeners, so sends block like they do in amqp091
+// without holding the broker lock.
+func (ch *memChannel) notifier() {
+	b := ch.broker()
+	for {
+		b.mu.Lock()
+		for len(ch.notices) == 0 && !ch.closed {
+			b.cond.Wait()
+		}
+		confirms := append([]chan amqp.Confirmation(nil), ch.confirms...)
+		returns := append([]chan amqp.Return(nil), ch.returns...)
+		if len(ch.notices) == 0 {
+			ch.confirms, ch.returns = nil, nil
+			b.mu.Unlock()
+			for _, c := range confirms {
+				close(c)
+			}
+			for _, r := range returns {
+				close(r)
+			}
+			return
+		}
+		n := ch.notices[0]
+		ch.notices = ch.notices[1:]
+		b.mu.Unlock()
+
+		if n.ret != nil {
+			for _, r := range returns {
+				r <- *n.ret
+			}
+		}
+		if n.confirm != nil {
+			for _, c := range confirms {
+				c <- *n.confirm
+			}
+		}
+	}
+}
+
+func (ch *memChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, ch.failLocked(amqp.NotFound, "no queue '%s'", queue)
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return nil, ch.failLocked(amqp.ResourceLocked, "cannot obtain exclusive access to locked queue '%s'", queue)
+	}
+	if consumer == "" {
+		consumer = b.nextName("ctag")
+	}
+	if _, ok := ch.consumers[consumer]; ok {
+		return nil, ch.failLocked(amqp.NotAllowed, "attempt to reuse consumer tag '%s'", consumer)
+	}
+	c := &memConsumer{
+		tag:        consumer,
+		ch:         ch,
+		queue:      q,
+		autoAck:    autoAck,
+		deliveries: make(chan amqp.Delivery),
+		done:       make(chan struct{}),
+	}
+	ch.consumers[consumer] = c
+	q.consumers = append(q.consumers, c)
+	b.touchLocked(q)
+	go c.run()
+	return c.deliveries, nil
+}
+
+// Get is basic.get: it takes the message at the head of queue, if any,
+// outside of any consumer.
+func (ch *memChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.Delivery{}, false, amqp.ErrClosed
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return amqp.Delivery{}, false, ch.failLocked(amqp.NotFound, "no queue '%s'", queue)
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return amqp.Delivery{}, false, ch.failLocked(amqp.ResourceLocked, "cannot obtain exclusive access to locked queue '%s'", queue)
+	}
+	b.touchLocked(q)
+	b.expireLocked(q)
+	if len(q.messages) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+	m := q.popLocked()
+	d := ch.deliveryLocked(q, "", autoAck, m)
+	d.MessageCount = uint32(len(q.messages))
+	return d, true, nil
+}
+
+func (ch *memChannel) Cancel(consumer string, noWait bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	c, ok := ch.consumers[consumer]
+	if !ok {
+		return nil
+	}
+	b.cancelConsumerLocked(c)
+	return nil
+}
+
+func (ch *memChannel) Ack(tag uint64, multiple bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	msgs, err := ch.settleLocked(tag, multiple)
+	if err != nil {
+		return err
+	}
+	if len(msgs) > 0 {
+		b.cond.Broadcast()
+	}
+	return nil
+}
+
+func (ch *memChannel) Nack(tag uint64, multiple bool, requeue bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	msgs, err := ch.settleLocked(tag, multiple)
+	if err != nil {
+		return err
+	}
+	for i := len(msgs) - 1; i >= 0; i-- {
+		u := msgs[i]
+		if requeue {
+			u.msg.redelivered = true
+			u.queue.pushFront(u.msg)
+			continue
+		}
+		b.deadLetterLocked(u.queue, u.msg, "rejected")
+	}
+	b.cond.Broadcast()
+	return nil
+}
+
+func (ch *memChannel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+// settleLocked removes tag (and everything before it when multiple is set)
+// from the unacked set, oldest first.
+func (ch *memChannel) settleLocked(tag uint64, multiple bool) ([]memUnacked, error) {
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+	if !multiple {
+		u, ok := ch.unacked[tag]
+		if !ok {
+			return nil, ch.failLocked(amqp.PreconditionFailed, "unknown delivery tag %d", tag)
+		}
+		delete(ch.unacked, tag)
+		return []memUnacked{u}, nil
+	}
+	tags := []uint64{}
+	for t := range ch.unacked {
+		if t <= tag {
+			tags = append(tags, t)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	msgs := make([]memUnacked, 0, len(tags))
+	for _, t := range tags {
+		msgs = append(msgs, ch.unacked[t])
+		delete(ch.unacked, t)
+	}
+	return msgs, nil
+}
+
+func (ch *memChannel) windowOpenLocked() bool {
+	return ch.prefetch <= 0 || len(ch.unacked) < ch.prefetch
+}
+
+func (ch *memChannel) deliveryLocked(q *memQueue, consumer string, autoAck bool, m *memMessage) amqp.Delivery {
+	ch.nextTag++
+	if !autoAck {
+		ch.unacked[ch.nextTag] = memUnacked{queue: q, msg: m}
+	}
+	p := m.pub
+	return amqp.Delivery{
+		Acknowledger:    ch,
+		Headers:         p.Headers,
+		ContentType:     p.ContentType,
+		ContentEncoding: p.ContentEncoding,
+		DeliveryMode:    p.DeliveryMode,
+		Priority:        p.Priority,
+		CorrelationId:   p.CorrelationId,
+		ReplyTo:         p.ReplyTo,
+		Expiration:      p.Expiration,
+		MessageId:       p.MessageId,
+		Timestamp:       p.Timestamp,
+		Type:            p.Type,
+		UserId:          p.UserId,
+		AppId:           p.AppId,
+		ConsumerTag:     consumer,
+		DeliveryTag:     ch.nextTag,
+		Redelivered:     m.redelivered,
+		Exchange:        m.exchange,
+		RoutingKey:      m.key,
+		Body:            p.Body,
+	}
+}
+
+func (c *memConsumer) run() {
+	b := c.ch.broker()
+	defer close(c.deliveries)
+	for {
+		b.mu.Lock()
+		b.expireLocked(c.queue)
+		for !c.cancelled && (len(c.queue.messages) == 0 || !c.ch.windowOpenLocked() || !c.activeLocked()) {
+			b.cond.Wait()
+			b.expireLocked(c.queue)
+		}
+		if c.cancelled {
+			b.mu.Unlock()
+			return
+		}
+		m := c.queue.popLocked()
+		d := c.ch.deliveryLocked(c.queue, c.tag, c.autoAck, m)
+		b.mu.Unlock()
+
+		select {
+		case c.deliveries <- d:
+		case <-c.done:
+			b.mu.Lock()
+			if _, ok := c.ch.unacked[d.DeliveryTag]; ok || c.autoAck {
+				delete(c.ch.unacked, d.DeliveryTag)
+				c.queue.pushFront(m)
+				b.cond.Broadcast()
+			}
+			b.mu.Unlock()
+			return
+		}
+	}
+}
+
+// activeLocked is false for every consumer but the first on a queue with
+// x-single-active-consumer.
+func (c *memConsumer) activeLocked() bool {
+	if sac, _ := c.queue.args["x-single-active-consumer"].(bool); !sac {
+		return true
+	}
+	return len(c.queue.consumers) > 0 && c.queue.consumers[0] == c
+}
+
+// touchLocked marks q as used and, if it has x-expires and no consumers,
+// schedules its deletion should it stay unused that long.
+func (b *MemoryBroker) touchLocked(q *memQueue) {
+	q.used++
+	ms, ok := q.limit("x-expires")
+	if !ok || q.deleted || len(q.consumers) > 0 {
+		return
+	}
+	used := q.used
+	time.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if q.used == used && len(q.consumers) == 0 {
+			b.deleteQueueLocked(q)
+		}
+	})
+}
+
+func (b *MemoryBroker) cancelConsumerLocked(c *memConsumer) {
+	if c.cancelled {
+		return
+	}
+	c.cancelled = true
+	close(c.done)
+	delete(c.ch.consumers, c.tag)
+	q := c.queue
+	for i, qc := range q.consumers {
+		if qc == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+	if q.autoDelete && len(q.consumers) == 0 && !q.deleted {
+		b.deleteQueueLocked(q)
+	}
+	b.touchLocked(q)
+	b.cond.Broadcast()
+}
+
+func (b *MemoryBroker) deleteQueueLocked(q *memQueue) {
+	if q.deleted {
+		return
+	}
+	q.deleted = true
+	delete(b.queues, q.name)
+	for _, ex := range b.exchanges {
+		kept := ex.bindings[:0]
+		for _, bd := range ex.bindings {
+			if bd.queue != q.name {
+				kept = append(kept, bd)
+			}
+		}
+		ex.bindings = kept
+	}
+	for _, c := range append([]*memConsumer(nil), q.consumers...) {
+		b.cancelConsumerLocked(c)
+	}
+}
+
+func (q *memQueue) pushFront(m *memMessage) {
+	if q.deleted {
+		return
+	}
+	q.messages = append([]*memMessage{m}, q.messages...)
+	q.bytes += len(m.pub.Body)
+}
+
+// routeLocked delivers msg to every queue bound to exchange under key and
+// returns how many queues received it.
+// A queue that is full under reject-publish turns the publish into a nack
+// rather than taking it.
+func (b *MemoryBroker) routeLocked(exchange, key string, msg amqp.Publishing) (int, bool, error) {
+	var targets []*memQueue
+	if exchange == "" {
+		if q, ok := b.queues[key]; ok {
+			targets = append(targets, q)
+		}
+	} else {
+		ex, ok := b.exchanges[exchange]
+		if !ok {
+			return 0, false, &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("no exchange '%s'", exchange)}
+		}
+		seen := map[string]bool{}
+		for _, bd := range ex.bindings {
+			if seen[bd.queue] || !ex.matches(bd.key, key) {
+				continue
+			}
+			seen[bd.queue] = true
+			targets = append(targets, b.queues[bd.queue])
+		}
+	}
+	rejected := false
+	for _, q := range targets {
+		if overflow, _ := q.arg("x-overflow").(string); overflow == string(RejectPublish) && q.fullLocked(len(msg.Body)) {
+			rejected = true
+			continue
+		}
+		pub := msg
+		pub.Body = append([]byte(nil), msg.Body...)
+		if msg.Headers != nil {
+			pub.Headers = amqp.Table{}
+			for k, v := range msg.Headers {
+				pub.Headers[k] = v
+			}
+		}
+		m := &memMessage{exchange: exchange, key: key, pub: pub}
+		if ttl, ok := messageTTL(q, msg); ok {
+			m.expires = time.Now().Add(ttl)
+			time.AfterFunc(ttl, func() {
+				b.mu.Lock()
+				defer b.mu.Unlock()
+				b.expireLocked(q)
+			})
+		}
+		q.messages = append(q.messages, m)
+		q.bytes += len(pub.Body)
+		for len(q.messages) > 0 && q.fullLocked(0) {
+			head := q.popLocked()
+			b.deadLetterLocked(q, head, "maxlen")
+		}
+	}
+	if len(targets) > 0 {
+		b.cond.Broadcast()
+	}
+	return len(targets), rejected, nil
+}
+
+// fullLocked reports whether q would be over x-max-length or
+// x-max-length-bytes with one more message of size n in it, or already is
+// over them when n is 0.
+func (q *memQueue) fullLocked(n int) bool {
+	count, extra := len(q.messages), 0
+	if n > 0 {
+		count, extra = count+1, n
+	}
+	if max, ok := q.limit("x-max-length"); ok && count > max {
+		return true
+	}
+	if max, ok := q.limit("x-max-length-bytes"); ok && q.bytes+extra > max {
+		return true
+	}
+	return false
+}
+
+// arg is the queue's argument for key or, if it was declared without
+// one, its policy's.
+func (q *memQueue) arg(key string) any {
+	if v, ok := q.args[key]; ok {
+		return v
+	}
+	return q.policy[key]
+}
+
+// limit is the lower of the queue's argument and its policy's for a
+// length, TTL or expiry.
+func (q *memQueue) limit(key string) (int, bool) {
+	a, aok := headerInt(q.args, key)
+	p, pok := headerInt(q.policy, key)
+	if aok && pok {
+		return min(a, p), true
+	}
+	if aok {
+		return a, true
+	}
+	return p, pok
+}
+
+func (q *memQueue) popLocked() *memMessage {
+	m := q.messages[0]
+	q.messages = q.messages[1:]
+	q.bytes -= len(m.pub.Body)
+	return m
+}
+
+// deadLetterLocked republishes m through the queue's dead letter exchange,
+// recording the hop in the x-death header the way RabbitMQ does.
+func (b *MemoryBroker) deadLetterLocked(q *memQueue, m *memMessage, reason string) {
+	dlx, ok := q.arg("x-dead-letter-exchange").(string)
+	if !ok {
+		return
+	}
+	key := m.key
+	if rk, ok := q.arg("x-dead-letter-routing-key").(string); ok {
+		key = rk
+	}
+	pub := m.pub
+	headers := amqp.Table{}
+	for k, v := range pub.Headers {
+		headers[k] = v
+	}
+	deaths, _ := headers["x-death"].([]interface{})
+	count := int64(1)
+	rest := make([]interface{}, 0, len(deaths))
+	for _, d := range deaths {
+		t, ok := d.(amqp.Table)
+		if ok && t["queue"] == q.name && t["reason"] == reason {
+			if n, ok := t["count"].(int64); ok {
+				count = n + 1
+			}
+			continue
+		}
+		rest = append(rest, d)
+	}
+	death := amqp.Table{
+		"count":        count,
+		"reason":       reason,
+		"queue":        q.name,
+		"time":         time.Now(),
+		"exchange":     m.exchange,
+		"routing-keys": []interface{}{m.key},
+	}
+	headers["x-death"] = append([]interface{}{death}, rest...)
+	if _, ok := headers["x-first-death-queue"]; !ok {
+		headers["x-first-death-queue"] = q.name
+		headers["x-first-death-reason"] = reason
+		headers["x-first-death-exchange"] = m.exchange
+	}
+	pub.Headers = headers
+	b.routeLocked(dlx, key, pub)
+}
+
+// equivalentArgs compares the x- arguments RabbitMQ checks on redeclare.
+func equivalentArgs(a, b amqp.Table) bool {
+	keys := map[string]bool{}
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	for k := range keys {
+		if !strings.HasPrefix(k, "x-") {
+			continue
+		}
+		if ai, ok := headerInt(a, k); ok {
+			if bi, ok := headerInt(b, k); !ok || ai != bi {
+				return false
+			}
+			continue
+		}
+		if fmt.Sprint(a[k]) != fmt.Sprint(b[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+// messageTTL is the shorter of the queue's x-message-ttl and the
+// message's own expiration.
+func messageTTL(q *memQueue, msg amqp.Publishing) (time.Duration, bool) {
+	ttl, ok := time.Duration(0), false
+	if ms, set := q.limit("x-message-ttl"); set {
+		ttl, ok = time.Duration(ms)*time.Millisecond, true
+	}
+	if msg.Expiration != "" {
+		if ms, err := strconv.Atoi(msg.Expiration); err == nil {
+			d := time.Duration(ms) * time.Millisecond
+			if !ok || d < ttl {
+				ttl, ok = d, true
+			}
+		}
+	}
+	return ttl, ok
+}
+
+// expireLocked dead-letters expired messages from the head of q, which is
+// the only place RabbitMQ expires them from.
+func (b *MemoryBroker) expireLocked(q *memQueue) {
+	now := time.Now()
+	for len(q.messages) > 0 {
+		m := q.messages[0]
+		if m.expires.IsZero() || m.expires.After(now) {
+			return
+		}
+		q.popLocked()
+		b.deadLetterLocked(q, m, "expired")
+	}
+}
+
+func (ex *memExchange) matches(bindingKey, routingKey string) bool {
+	switch ex.kind {
+	case amqp.ExchangeFanout:
+		return true
+	case amqp.ExchangeTopic:
+		return routing.MatchTopic(bindingKey, routingKey)
+	default:
+		return bindingKey == routingKey
+	}
+}
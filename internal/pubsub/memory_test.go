@@ -0,0 +1,324 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func memChannelFor(t *testing.T, b *MemoryBroker) Channel {
+	t.Helper()
+	ch, err := b.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ch.Close() })
+	return ch
+}
+
+// drain gets every ready message from queue and returns their bodies.
+func drain(t *testing.T, ch Channel, queue string) []string {
+	t.Helper()
+	var bodies []string
+	for {
+		d, ok, err := ch.Get(queue, true)
+		if err != nil {
+			t.Fatalf("get %s: %v", queue, err)
+		}
+		if !ok {
+			return bodies
+		}
+		bodies = append(bodies, string(d.Body))
+	}
+}
+
+func TestMemoryRouting(t *testing.T) {
+	tests := []struct {
+		name     string
+		kind     string
+		bindings map[string]string // queue -> binding key
+		key      string
+		want     []string // queues that get the message
+	}{
+		{"direct match", amqp.ExchangeDirect, map[string]string{"a": "k", "b": "other"}, "k", []string{"a"}},
+		{"direct none", amqp.ExchangeDirect, map[string]string{"a": "k"}, "x", nil},
+		{"topic star", amqp.ExchangeTopic, map[string]string{"a": "army_moves.*", "b": "army_moves"}, "army_moves.bob", []string{"a"}},
+		{"topic hash", amqp.ExchangeTopic, map[string]string{"a": "game_logs.#", "b": "#", "c": "war.*"}, "game_logs.bob", []string{"a", "b"}},
+		{"fanout", amqp.ExchangeFanout, map[string]string{"a": "x", "b": "y"}, "ignored", []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewMemoryBroker()
+			ch := memChannelFor(t, b)
+			if err := ch.ExchangeDeclare("ex", tt.kind, false, false, false, false, nil); err != nil {
+				t.Fatal(err)
+			}
+			for q, key := range tt.bindings {
+				if _, err := ch.QueueDeclare(q, false, false, false, false, nil); err != nil {
+					t.Fatal(err)
+				}
+				if err := ch.QueueBind(q, key, "ex", false, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ch.PublishWithContext(context.Background(), "ex", tt.key, false, false,
+				amqp.Publishing{Body: []byte("hi")}); err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]bool{}
+			for q := range tt.bindings {
+				if bodies := drain(t, ch, q); len(bodies) > 0 {
+					got[q] = true
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("delivered to %v, want %v", got, tt.want)
+			}
+			for _, q := range tt.want {
+				if !got[q] {
+					t.Errorf("queue %s got nothing", q)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryDefaultExchange(t *testing.T) {
+	b := NewMemoryBroker()
+	ch := memChannelFor(t, b)
+	if _, err := ch.QueueDeclare("q", false, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.PublishWithContext(context.Background(), "", "q", false, false,
+		amqp.Publishing{Body: []byte("direct to queue")}); err != nil {
+		t.Fatal(err)
+	}
+	if got := drain(t, ch, "q"); len(got) != 1 || got[0] != "direct to queue" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestMemoryConfirms(t *testing.T) {
+	b := NewMemoryBroker()
+	ch := memChannelFor(t, b)
+	if err := ch.ExchangeDeclare("ex", amqp.ExchangeDirect, false, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("q", false, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("q", "k", "ex", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := NewConfirmedPublisher(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	if err := PublishJSON(pub, "ex", "k", "routed"); err != nil {
+		t.Errorf("routed publish: %v", err)
+	}
+	err = PublishJSON(pub, "ex", "nowhere", "lost")
+	var returned *ReturnedError
+	if !errors.Is(err, ErrUnroutable) || !errors.As(err, &returned) {
+		t.Fatalf("unroutable publish: got %v, want a ReturnedError", err)
+	}
+	if returned.RoutingKey != "nowhere" || returned.ReplyCode != amqp.NoRoute {
+		t.Errorf("returned %+v", returned)
+	}
+
+	batch := pub.Batch()
+	for range 3 {
+		if err := PublishJSON(batch, "ex", "k", "batched"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	PublishJSON(batch, "ex", "nowhere", "lost")
+	if err := batch.Wait(context.Background()); !errors.Is(err, ErrUnroutable) {
+		t.Errorf("batch: got %v, want one unroutable", err)
+	}
+	if got := drain(t, ch, "q"); len(got) != 4 {
+		t.Errorf("queue has %d messages, want 4", len(got))
+	}
+}
+
+func TestMemorySubscribe(t *testing.T) {
+	b := NewMemoryBroker()
+	ch := memChannelFor(t, b)
+	if err := ch.ExchangeDeclare("ex", amqp.ExchangeTopic, false, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	type greeting struct{ Text string }
+	got := make(chan Message[greeting], 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err := SubscribeMessage(ctx, b, "ex", "greetings", "greet.*", Transient,
+		func(msg Message[greeting]) Acktype {
+			got <- msg
+			return Ack
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PublishJSON(ch, "ex", "greet.bob", greeting{"hello"}, WithCorrelationID("c1")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-got:
+		if msg.Body.Text != "hello" || msg.RoutingKey != "greet.bob" || msg.CorrelationID != "c1" {
+			t.Errorf("got %+v", msg)
+		}
+		if msg.ContentType != ContentTypeJSON || msg.MessageID == "" {
+			t.Errorf("envelope not filled in: %+v", msg.Metadata)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not delivered")
+	}
+	cancel()
+	if err := sub.Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
+// deadLetterSetup declares a fanout dead letter exchange with queue dlq
+// bound to it and returns a channel to inspect it with.
+func deadLetterSetup(t *testing.T, b *MemoryBroker) Channel {
+	t.Helper()
+	ch := memChannelFor(t, b)
+	if err := ch.ExchangeDeclare("dlx", amqp.ExchangeFanout, false, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("dlq", false, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("dlq", "", "dlx", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	return ch
+}
+
+func TestMemoryDeadLetter(t *testing.T) {
+	b := NewMemoryBroker()
+	ch := deadLetterSetup(t, b)
+	if _, err := DeclareQueue(ch, "work", Durable, QueueOptions{DeadLetterExchange: "dlx"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.PublishWithContext(context.Background(), "", "work", false, false,
+		amqp.Publishing{Body: []byte("bad")}); err != nil {
+		t.Fatal(err)
+	}
+	d, ok, err := ch.Get("work", false)
+	if err != nil || !ok {
+		t.Fatalf("get: %v %v", ok, err)
+	}
+	if err := d.Nack(false, false); err != nil {
+		t.Fatal(err)
+	}
+	dead, ok, err := ch.Get("dlq", true)
+	if err != nil || !ok {
+		t.Fatalf("nothing dead-lettered: %v", err)
+	}
+	dl := ParseDeadLetter(dead)
+	if string(dl.Body) != "bad" || dl.Queue != "work" || dl.Reason != "rejected" {
+		t.Errorf("dead letter %+v", dl)
+	}
+}
+
+func TestMemoryTTL(t *testing.T) {
+	b := NewMemoryBroker()
+	ch := deadLetterSetup(t, b)
+	if _, err := DeclareQueue(ch, "short", Durable, QueueOptions{DeadLetterExchange: "dlx", MessageTTL: 20 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DeclareQueue(ch, "long", Durable, QueueOptions{DeadLetterExchange: "dlx"}); err != nil {
+		t.Fatal(err)
+	}
+	publish := func(queue, body, expiration string) {
+		t.Helper()
+		if err := ch.PublishWithContext(context.Background(), "", queue, false, false,
+			amqp.Publishing{Body: []byte(body), Expiration: expiration}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publish("short", "queue ttl", "")
+	publish("long", "message ttl", "20")
+	publish("long", "kept", "")
+
+	deadline := time.Now().Add(2 * time.Second)
+	var dead []string
+	for len(dead) < 2 && time.Now().Before(deadline) {
+		dead = append(dead, drain(t, ch, "dlq")...)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(dead) != 2 {
+		t.Fatalf("dead-lettered %q, want both expired messages", dead)
+	}
+	if got := drain(t, ch, "long"); len(got) != 1 || got[0] != "kept" {
+		t.Errorf("long queue has %q, want only the unexpiring message", got)
+	}
+}
+
+func TestMemoryMaxLength(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   QueueOptions
+		policy *QueueOptions
+		// kept is what stays in the queue after publishing 1 to 4, dead
+		// the oldest messages dropped into the dead letter queue and
+		// nacked how many of the publishes were refused.
+		kept, dead []string
+		nacked     int
+	}{
+		{"drop head", QueueOptions{MaxLength: 2, Overflow: DropHead}, nil, []string{"3", "4"}, []string{"1", "2"}, 0},
+		{"reject publish", QueueOptions{MaxLength: 2, Overflow: RejectPublish}, nil, []string{"1", "2"}, nil, 2},
+		{"bytes", QueueOptions{MaxLengthBytes: 3}, nil, []string{"2", "3", "4"}, []string{"1"}, 0},
+		{"policy", QueueOptions{}, &QueueOptions{MaxLength: 3, Overflow: RejectPublish}, []string{"1", "2", "3"}, nil, 1},
+		{"lower of argument and policy", QueueOptions{MaxLength: 1}, &QueueOptions{MaxLength: 3}, []string{"4"}, []string{"1", "2", "3"}, 0},
+		{"argument overflow wins", QueueOptions{MaxLength: 2, Overflow: DropHead}, &QueueOptions{Overflow: RejectPublish}, []string{"3", "4"}, []string{"1", "2"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewMemoryBroker()
+			ch := deadLetterSetup(t, b)
+			if tt.policy != nil {
+				if err := b.SetPolicy(Policy{Name: "cap", Pattern: "^capped$", Queue: *tt.policy}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			o := tt.args
+			o.DeadLetterExchange = "dlx"
+			if _, err := DeclareQueue(ch, "capped", Durable, o); err != nil {
+				t.Fatal(err)
+			}
+			pub, err := NewConfirmedPublisher(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pub.Close()
+			nacked := 0
+			for _, body := range []string{"1", "2", "3", "4"} {
+				err := pub.PublishWithContext(context.Background(), "", "capped", false, false,
+					amqp.Publishing{Body: []byte(body)})
+				switch {
+				case errors.Is(err, ErrNacked):
+					nacked++
+				case err != nil:
+					t.Fatal(err)
+				}
+			}
+			if nacked != tt.nacked {
+				t.Errorf("%d publishes nacked, want %d", nacked, tt.nacked)
+			}
+			if got := drain(t, ch, "capped"); fmt.Sprint(got) != fmt.Sprint(tt.kept) {
+				t.Errorf("queue holds %q, want %q", got, tt.kept)
+			}
+			if got := drain(t, ch, "dlq"); fmt.Sprint(got) != fmt.Sprint(tt.dead) {
+				t.Errorf("dead-lettered %q, want %q", got, tt.dead)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package pubsub
+
+import (
+	"context"
+	"log"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// HandlerFunc is a subscription handler with the body already bound: it
+// sees the envelope and decides how the delivery is settled. The typed
+// handler passed to Subscribe sits at the end of the chain.
+type HandlerFunc func(ctx context.Context, md Metadata) Acktype
+
+// Middleware wraps a HandlerFunc. Middlewares given to WithMiddleware run
+// in order, the first one outermost.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// WithMiddleware adds middlewares around the subscription's handler.
+func WithMiddleware(mw ...Middleware) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.middleware = append(o.middleware, mw...)
+	}
+}
+
+func chain(h HandlerFunc, mw []Middleware) HandlerFunc {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// Recover turns a panicking handler into NackDiscard, so the message is
+// dead-lettered instead of taking the subscription down.
+func Recover() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, md Metadata) (ack Acktype) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("panic handling %s %s from %s: %v\n%s",
+						md.Type, md.MessageID, md.RoutingKey, r, debug.Stack())
+					ack = NackDiscard
+				}
+			}()
+			return next(ctx, md)
+		}
+	}
+}
+
+// Logging logs every delivery that is not acked, with how long the
+// handler took. verbose logs acked ones too.
+func Logging(l *log.Logger, verbose bool) Middleware {
+	if l == nil {
+		l = log.Default()
+	}
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, md Metadata) Acktype {
+			start := time.Now()
+			ack := next(ctx, md)
+			if ack != Ack || verbose {
+				l.Printf("%s %s from %s: %s after %v",
+					md.Type, md.MessageID, md.RoutingKey, ack, time.Since(start))
+			}
+			return ack
+		}
+	}
+}
+
+// Timing reports how long each handler call took.
+func Timing(observe func(md Metadata, ack Acktype, d time.Duration)) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, md Metadata) Acktype {
+			start := time.Now()
+			ack := next(ctx, md)
+			observe(md, ack, time.Since(start))
+			return ack
+		}
+	}
+}
+
+// Timeout gives each handler d to finish. A handler that overruns has its
+// message dead-lettered rather than requeued: it keeps running and may
+// still apply the message, so handing it to another handler could apply
+// it twice. Its result is ignored, and handlers that can stop early should
+// watch Message.Context. The handler runs on its own goroutine, so list
+// Recover after Timeout to catch its panics.
+func Timeout(d time.Duration) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, md Metadata) Acktype {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+			result := make(chan Acktype, 1)
+			go func() {
+				result <- next(ctx, md)
+			}()
+			select {
+			case ack := <-result:
+				return ack
+			case <-ctx.Done():
+				log.Printf("%s %s from %s timed out after %v",
+					md.Type, md.MessageID, md.RoutingKey, d)
+				return NackDiscard
+			}
+		}
+	}
+}
+
+// Metrics counts deliveries by outcome. Its zero value is ready to use.
+type Metrics struct {
+	Handled   atomic.Int64
+	Acked     atomic.Int64
+	Requeued  atomic.Int64
+	Discarded atomic.Int64
+	// Busy is the total time spent in handlers, in nanoseconds.
+	Busy atomic.Int64
+}
+
+func (m *Metrics) Middleware() Middleware {
+	return Timing(func(md Metadata, ack Acktype, d time.Duration) {
+		m.Handled.Add(1)
+		m.Busy.Add(int64(d))
+		switch ack {
+		case Ack:
+			m.Acked.Add(1)
+		case NackRequeue:
+			m.Requeued.Add(1)
+		case NackDiscard:
+			m.Discarded.Add(1)
+		}
+	})
+}
@@ -0,0 +1,29 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTimeoutDiscardsOverrunningHandler(t *testing.T) {
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	slow := func(ctx context.Context, md Metadata) Acktype {
+		<-release
+		close(finished)
+		return Ack
+	}
+	h := chain(slow, []Middleware{Timeout(10 * time.Millisecond)})
+	if got := h(context.Background(), Metadata{}); got != NackDiscard {
+		t.Errorf("overrun settled as %v, want %v", got, NackDiscard)
+	}
+	close(release)
+	<-finished
+
+	fast := chain(func(context.Context, Metadata) Acktype { return NackRequeue },
+		[]Middleware{Timeout(time.Second)})
+	if got := fast(context.Background(), Metadata{}); got != NackRequeue {
+		t.Errorf("handler in time settled as %v, want its own %v", got, NackRequeue)
+	}
+}
@@ -0,0 +1,87 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeManagement is the policies part of the RabbitMQ management API.
+type fakeManagement struct {
+	mu       sync.Mutex
+	policies map[string]managementPolicy
+	paths    []string
+}
+
+func (f *fakeManagement) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paths = append(f.paths, r.Method+" "+r.URL.EscapedPath())
+	if user, pass, ok := r.BasicAuth(); !ok || user != "admin" || pass != "secret" {
+		http.Error(w, `{"error":"not_authorised"}`, http.StatusUnauthorized)
+		return
+	}
+	const prefix = "/api/policies/%2F"
+	path := r.URL.EscapedPath()
+	switch {
+	case r.Method == http.MethodGet && path == prefix:
+		list := []managementPolicy{{Name: "other", Pattern: ".*", ApplyTo: "exchanges"}}
+		for _, p := range f.policies {
+			list = append(list, p)
+		}
+		json.NewEncoder(w).Encode(list)
+	case r.Method == http.MethodPut && strings.HasPrefix(path, prefix+"/"):
+		var p managementPolicy
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.Name = strings.TrimPrefix(path, prefix+"/")
+		f.policies[p.Name] = p
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestManagementPolicies(t *testing.T) {
+	fake := &fakeManagement{policies: map[string]managementPolicy{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	m := &Management{URL: strings.Replace(srv.URL, "http://", "http://admin:secret@", 1) + "/"}
+
+	want := Policy{Name: "capped", Pattern: "^logs$", Priority: 2, Queue: QueueOptions{
+		MaxLength: 100, MaxLengthBytes: 1 << 20, Overflow: RejectPublish,
+		MessageTTL: time.Minute, DeadLetterExchange: "dlx", Lazy: true,
+	}}
+	if err := m.SetPolicy(want); err != nil {
+		t.Fatal(err)
+	}
+	if p := fake.policies["capped"]; p.ApplyTo != "queues" || p.Definition["max-length"] != 100.0 || p.Definition["overflow"] != "reject-publish" {
+		t.Errorf("stored %+v", p)
+	}
+	got, err := m.Policies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("listed %+v, want only %+v", got, want)
+	}
+	if fake.paths[0] != "PUT /api/policies/%2F/capped" {
+		t.Errorf("requested %v", fake.paths)
+	}
+
+	if err := m.SetPolicy(Policy{Name: "quorum", Queue: QueueOptions{Kind: QuorumQueue}}); err == nil {
+		t.Error("set a policy with a queue kind")
+	}
+	bad := &Management{URL: srv.URL}
+	if _, err := bad.Policies(); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("without credentials: %v, want 401", err)
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"log"
 
 	amqp "github.com/rabbitmq/amqp091-go"
-	"github.com/tdabry/learn-pub-sub-starter/internal/routing"
 )
 
 type SimpleQueueType int
@@ -26,106 +25,137 @@ const (
 	NackDiscard
 )
 
-func PublishJSON[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	val_json, err := json.Marshal(val)
+func (a Acktype) String() string {
+	switch a {
+	case Ack:
+		return "ack"
+	case NackRequeue:
+		return "nack-requeue"
+	case NackDiscard:
+		return "nack-discard"
+	}
+	return "unknown"
+}
+
+// Publish encodes val with codec and publishes it in the standard
+// envelope: the codec's content type (which is what subscribers decode
+// by), a fresh message id, timestamp, app id, type name and schema version.
+func Publish[T any](ch Publisher, codec Codec, exchange, key string, val T, opts ...PublishOption) error {
+	msg, err := newPublishing(codec, val, opts)
 	if err != nil {
 		return err
 	}
-	return ch.PublishWithContext(context.Background(), exchange, key, false, false,
-		amqp.Publishing{ContentType: "application/json", Body: val_json})
+	return ch.PublishWithContext(context.Background(), exchange, key, false, false, msg)
+}
 
+func PublishJSON[T any](ch Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	return Publish(ch, JSON, exchange, key, val, opts...)
+}
+
+func PublishProto[T any](ch Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	return Publish(ch, Proto, exchange, key, val, opts...)
 }
 
 func DeclareAndBind(
-	conn *amqp.Connection,
+	conn Broker,
 	exchange,
 	queueName,
 	key string,
 	queueType SimpleQueueType, // an enum to represent "durable" or "transient"
-) (*amqp.Channel, amqp.Queue, error) {
+) (Channel, amqp.Queue, error) {
+	return declareAndBind(conn, exchange, queueName, key, queueType, QueueOptions{})
+}
+
+func declareAndBind(conn Broker, exchange, queueName, key string,
+	queueType SimpleQueueType, opts QueueOptions) (Channel, amqp.Queue, error) {
 	ch, err := conn.Channel()
 	if err != nil {
 		log.Print("error creating channel")
 		return nil, amqp.Queue{}, err
 	}
-	dur := false
-	autodel := false
-	excl := false
-	switch queueType {
-	case Durable:
-		dur = true
-	case Transient:
-		autodel = true
-		excl = true
-	}
 
-	newQ, err := ch.QueueDeclare(queueName, dur, autodel, excl, false,
-		amqp.Table{"x-dead-letter-exchange": routing.ExchangePerilDead})
+	newQ, err := DeclareQueue(ch, queueName, queueType, opts)
 	if err != nil {
 		log.Print("error declaring queue")
+		ch.Close()
 		return nil, amqp.Queue{}, err
 	}
 	err = ch.QueueBind(queueName, key, exchange, false, nil)
 	if err != nil {
 		log.Printf("error binding queue\nqName: %s, key: %s, ex: %s", queueName, key, exchange)
+		ch.Close()
 		return nil, amqp.Queue{}, err
 	}
 	return ch, newQ, nil
 }
 
-func PublishGob[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	var network bytes.Buffer
-	encoder := gob.NewEncoder(&network)
-	err := encoder.Encode(val)
-	if err != nil {
-		return err
-	}
-	return ch.PublishWithContext(context.Background(), exchange, key, false, false,
-		amqp.Publishing{ContentType: "application/gob", Body: network.Bytes()})
-
+func PublishGob[T any](ch Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	return Publish(ch, Gob, exchange, key, val, opts...)
 }
 
 func Subscribe[T any](
-	conn *amqp.Connection,
+	ctx context.Context,
+	conn Broker,
 	exchange,
 	queueName,
 	key string,
 	queueType SimpleQueueType, // an enum to represent "durable" or "transient"
 	handler func(T) Acktype,
-	unmarshaller func([]byte) (T, error),
-) error {
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return SubscribeMessage(ctx, conn, exchange, queueName, key, queueType,
+		func(msg Message[T]) Acktype { return handler(msg.Body) }, opts...)
+}
 
-	ch, _, err := DeclareAndBind(conn, exchange, queueName, key, queueType)
-	if err != nil {
-		log.Printf("%s %s", queueName, key)
-		return err
-	}
-	ch.Qos(10, 0, true)
-	deliveryCh, err := ch.Consume(queueName, "", false, false, false, false, nil)
-	if err != nil {
-		return err
+// SubscribeMessage is Subscribe for handlers that also want the envelope.
+func SubscribeMessage[T any](
+	ctx context.Context,
+	conn Broker,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler func(Message[T]) Acktype,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+
+	spec := consumerSpec{conn: conn, exchange: exchange, queueName: queueName,
+		key: key, queueType: queueType, opts: newSubscribeOptions(opts)}
+	// Handlers outlive cancellation of ctx: shutdown waits for them rather
+	// than interrupting them.
+	hctx := context.WithoutCancel(ctx)
+	var retry *retrier
+	if spec.opts.retry != nil {
+		retry = newRetrier(*spec.opts.retry, queueName)
 	}
-	go func() {
-		defer ch.Close()
-		for el := range deliveryCh {
-			decoded, err := unmarshaller(el.Body)
+	sub, err := startSubscription(ctx, spec, func(ch Channel, el amqp.Delivery) {
+		core := func(ctx context.Context, md Metadata) Acktype {
+			decoded, err := decode[T](el, spec.opts.defaultCodec)
 			if err != nil {
-				log.Print("error unmarshalling")
-				el.Nack(false, false)
-			} else {
-				ackType := handler(decoded)
-				switch ackType {
-				case Ack:
-					el.Ack(false)
-				case NackRequeue:
-					el.Nack(false, true)
-				case NackDiscard:
-					el.Nack(false, false)
-				}
+				log.Printf("error unmarshalling %s from %s: %v", el.ContentType, queueName, err)
+				return NackDiscard
+			}
+			return handler(Message[T]{Metadata: md, Body: decoded, ctx: ctx})
+		}
+		ackType := chain(core, spec.opts.middleware)(hctx, metadataFrom(el))
+		switch ackType {
+		case Ack:
+			el.Ack(false)
+		case NackRequeue:
+			if retry != nil {
+				retry.retry(ch, el)
+				return
 			}
+			el.Nack(false, true)
+		case NackDiscard:
+			el.Nack(false, false)
 		}
-	}()
-	return nil
+	})
+	if err != nil {
+		log.Printf("%s %s", queueName, key)
+		return nil, err
+	}
+	return sub, nil
 }
 
 func Gob_unmarshal[T any](body []byte) (T, error) {
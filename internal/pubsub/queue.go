@@ -0,0 +1,126 @@
+package pubsub
+
+import (
+	"errors"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/tdabry/learn-pub-sub-starter/internal/routing"
+)
+
+type QueueKind string
+
+const (
+	ClassicQueue QueueKind = "classic"
+	QuorumQueue  QueueKind = "quorum"
+)
+
+// Overflow is what a full queue does with a new message.
+type Overflow string
+
+const (
+	// DropHead dead-letters the oldest message to make room.
+	DropHead Overflow = "drop-head"
+	// RejectPublish refuses the new message; confirmed publishers get a nack.
+	RejectPublish Overflow = "reject-publish"
+)
+
+// QueueOptions are the queue arguments DeclareQueue sets on top of the
+// SimpleQueueType flags. The zero value is a classic queue with no limits.
+type QueueOptions struct {
+	Kind QueueKind
+	// DeadLetterExchange is where rejected, expired and dropped messages
+	// go. DeclareQueue fills in routing.ExchangePerilDead if it is empty,
+	// and subscriptions the one given to WithDeadLetterExchange.
+	DeadLetterExchange string
+	// MessageTTL dead-letters messages that have waited this long.
+	MessageTTL time.Duration
+	// Expires deletes the queue once it has gone this long unused.
+	Expires time.Duration
+	// MaxLength and MaxLengthBytes cap the ready messages; Overflow says
+	// what happens beyond that.
+	MaxLength      int
+	MaxLengthBytes int
+	Overflow       Overflow
+	// SingleActiveConsumer delivers to one consumer at a time, failing
+	// over to the next when it goes away.
+	SingleActiveConsumer bool
+	// Lazy keeps classic queue messages on disk instead of in memory.
+	Lazy bool
+}
+
+// Args is the x- argument table for o.
+func (o QueueOptions) Args() amqp.Table {
+	args := amqp.Table{}
+	if o.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = o.DeadLetterExchange
+	}
+	if o.Kind != "" && o.Kind != ClassicQueue {
+		args["x-queue-type"] = string(o.Kind)
+	}
+	if o.MessageTTL > 0 {
+		args["x-message-ttl"] = o.MessageTTL.Milliseconds()
+	}
+	if o.Expires > 0 {
+		args["x-expires"] = o.Expires.Milliseconds()
+	}
+	if o.MaxLength > 0 {
+		args["x-max-length"] = int64(o.MaxLength)
+	}
+	if o.MaxLengthBytes > 0 {
+		args["x-max-length-bytes"] = int64(o.MaxLengthBytes)
+	}
+	if o.Overflow != "" {
+		args["x-overflow"] = string(o.Overflow)
+	}
+	if o.SingleActiveConsumer {
+		args["x-single-active-consumer"] = true
+	}
+	if o.Lazy {
+		args["x-queue-mode"] = "lazy"
+	}
+	return args
+}
+
+// flags maps a SimpleQueueType to the durable, autoDelete and exclusive
+// flags of queue.declare.
+func (queueType SimpleQueueType) flags() (durable, autoDelete, exclusive bool) {
+	switch queueType {
+	case Durable:
+		return true, false, false
+	case Transient:
+		return false, true, true
+	}
+	return false, false, false
+}
+
+// DeclareQueue declares a queue with the flags for queueType and the
+// arguments for o. Quorum queues have to be Durable.
+func DeclareQueue(ch Subscriber, name string, queueType SimpleQueueType, o QueueOptions) (amqp.Queue, error) {
+	if o.Kind == QuorumQueue && queueType != Durable {
+		return amqp.Queue{}, errors.New("pubsub: quorum queues must be durable")
+	}
+	if o.Kind == QuorumQueue && o.Lazy {
+		return amqp.Queue{}, errors.New("pubsub: lazy mode is only for classic queues")
+	}
+	if o.DeadLetterExchange == "" {
+		o.DeadLetterExchange = routing.ExchangePerilDead
+	}
+	durable, autoDelete, exclusive := queueType.flags()
+	return ch.QueueDeclare(name, durable, autoDelete, exclusive, false, o.Args())
+}
+
+// WithQueueOptions declares the subscription's queue with o.
+func WithQueueOptions(o QueueOptions) SubscribeOption {
+	return func(so *subscribeOptions) {
+		so.queue = o
+	}
+}
+
+// WithDeadLetterExchange dead-letters to exchange unless the queue options
+// name one themselves. Use it when the Peril exchanges are renamed.
+func WithDeadLetterExchange(exchange string) SubscribeOption {
+	return func(so *subscribeOptions) {
+		so.deadLetter = exchange
+	}
+}
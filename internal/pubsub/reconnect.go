@@ -0,0 +1,312 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type ConnState int
+
+const (
+	StateConnected ConnState = iota
+	StateDisconnected
+	StateReconnecting
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+var ErrManagerClosed = errors.New("pubsub: connection manager closed")
+
+// Backoff is an exponential delay between reconnect attempts.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+var DefaultBackoff = Backoff{Initial: 500 * time.Millisecond, Max: 30 * time.Second}
+
+func (b Backoff) next(d time.Duration) time.Duration {
+	d *= 2
+	if d > b.Max {
+		return b.Max
+	}
+	return d
+}
+
+// Manager is a Broker that survives connection loss. It watches the
+// underlying connection, redials with backoff when it drops and reports
+// every state change to NotifyState listeners. Subscriptions opened
+// through a Manager redeclare their queue and restart their consumer once
+// it is connected again, and publishing through the Manager waits for a
+// working channel.
+type Manager struct {
+	dial    func() (Broker, error)
+	backoff Backoff
+
+	// PublishTimeout bounds how long a publish waits for a connection
+	// when the caller's context has no deadline.
+	PublishTimeout time.Duration
+
+	mu       sync.Mutex
+	conn     Broker
+	ready    chan struct{}
+	done     chan struct{}
+	pub      Channel
+	watchers []chan ConnState
+	closers  []chan *amqp.Error
+	closed   bool
+}
+
+// NewManager dials once and returns an error if that first attempt fails;
+// later drops are retried forever.
+func NewManager(dial func() (Broker, error), backoff Backoff) (*Manager, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	m := &Manager{
+		dial:           dial,
+		backoff:        backoff,
+		PublishTimeout: 5 * time.Second,
+		ready:          make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	m.setConn(conn)
+	return m, nil
+}
+
+// DialManager is NewManager for a broker URL (see Connect).
+func DialManager(url string) (*Manager, error) {
+	return NewManager(func() (Broker, error) { return Connect(url) }, DefaultBackoff)
+}
+
+// DialManagerConfig is NewManager for a broker URL and connection settings
+// (see ConnectConfig).
+func DialManagerConfig(url string, cfg amqp.Config) (*Manager, error) {
+	return NewManager(func() (Broker, error) { return ConnectConfig(url, cfg) }, DefaultBackoff)
+}
+
+// NotifyState registers a listener for connection state changes. Sends
+// never block, so the receiver should be buffered.
+func (m *Manager) NotifyState(receiver chan ConnState) chan ConnState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.watchers = append(m.watchers, receiver)
+	return receiver
+}
+
+// Ready is closed while the manager holds a live connection.
+func (m *Manager) Ready() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ready
+}
+
+// Done is closed once the manager has been closed for good.
+func (m *Manager) Done() <-chan struct{} {
+	return m.done
+}
+
+func (m *Manager) Channel() (Channel, error) {
+	m.mu.Lock()
+	conn := m.conn
+	closed := m.closed
+	m.mu.Unlock()
+	if closed {
+		return nil, ErrManagerClosed
+	}
+	if conn == nil {
+		return nil, amqp.ErrClosed
+	}
+	return conn.Channel()
+}
+
+// NotifyClose only fires when the manager itself is closed; dropped
+// connections are handled internally.
+func (m *Manager) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		close(receiver)
+		return receiver
+	}
+	m.closers = append(m.closers, receiver)
+	return receiver
+}
+
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrManagerClosed
+	}
+	m.closed = true
+	close(m.done)
+	conn, pub := m.conn, m.pub
+	m.conn, m.pub = nil, nil
+	for _, c := range m.closers {
+		close(c)
+	}
+	m.closers = nil
+	m.notifyLocked(StateClosed)
+	m.mu.Unlock()
+
+	if pub != nil {
+		pub.Close()
+	}
+	if conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
+// PublishWithContext publishes on a channel owned by the manager. If that
+// channel or its connection was closed underneath it, it waits for a
+// reconnect and retries on a fresh channel until ctx expires.
+func (m *Manager) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if _, ok := ctx.Deadline(); !ok && m.PublishTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.PublishTimeout)
+		defer cancel()
+	}
+	for {
+		ch, err := m.publishChannel(ctx)
+		if err == nil {
+			err = ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+			if err == nil {
+				return nil
+			}
+			m.dropPublishChannel(ch)
+		}
+		if !errors.Is(err, amqp.ErrClosed) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-m.done:
+			return ErrManagerClosed
+		case <-time.After(m.backoff.Initial):
+		}
+	}
+}
+
+func (m *Manager) publishChannel(ctx context.Context) (Channel, error) {
+	select {
+	case <-m.Ready():
+	case <-m.done:
+		return nil, ErrManagerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pub != nil {
+		return m.pub, nil
+	}
+	if m.conn == nil {
+		return nil, amqp.ErrClosed
+	}
+	ch, err := m.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	m.pub = ch
+	return ch, nil
+}
+
+func (m *Manager) dropPublishChannel(ch Channel) {
+	m.mu.Lock()
+	if m.pub == ch {
+		m.pub = nil
+	}
+	m.mu.Unlock()
+	ch.Close()
+}
+
+func (m *Manager) setConn(conn Broker) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		conn.Close()
+		return
+	}
+	m.conn = conn
+	close(m.ready)
+	m.notifyLocked(StateConnected)
+	m.mu.Unlock()
+	go m.watch(conn)
+}
+
+func (m *Manager) watch(conn Broker) {
+	reason, ok := <-conn.NotifyClose(make(chan *amqp.Error, 1))
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.conn, m.pub = nil, nil
+	m.ready = make(chan struct{})
+	m.notifyLocked(StateDisconnected)
+	m.mu.Unlock()
+	if ok {
+		log.Printf("connection lost: %v", reason)
+	} else {
+		log.Print("connection closed")
+	}
+	m.reconnect()
+}
+
+func (m *Manager) reconnect() {
+	delay := m.backoff.Initial
+	for {
+		m.mu.Lock()
+		m.notifyLocked(StateReconnecting)
+		m.mu.Unlock()
+		conn, err := m.dial()
+		if err == nil {
+			m.setConn(conn)
+			return
+		}
+		log.Printf("reconnect failed, retrying in %v: %v", delay, err)
+		select {
+		case <-time.After(delay):
+		case <-m.done:
+			return
+		}
+		delay = m.backoff.next(delay)
+	}
+}
+
+func (m *Manager) notifyLocked(s ConnState) {
+	for _, w := range m.watchers {
+		select {
+		case w <- s:
+		default:
+		}
+	}
+}
+
+// reconnector is implemented by brokers that come back after a drop.
+type reconnector interface {
+	Ready() <-chan struct{}
+	Done() <-chan struct{}
+}
@@ -0,0 +1,85 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestManagerResubscribesAfterRestart(t *testing.T) {
+	b := NewMemoryBroker()
+	m, err := NewManager(func() (Broker, error) { return b.Connect(), nil },
+		Backoff{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := m.NotifyState(make(chan ConnState, 16))
+
+	ch, err := m.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only durable exchanges survive a restart.
+	if err := ch.ExchangeDeclare("ex", amqp.ExchangeDirect, true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	ch.Close()
+
+	got := make(chan string, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub, err := SubscribeMessage(ctx, m, "ex", "work", "work", Durable,
+		func(msg Message[string]) Acktype {
+			got <- msg.Body
+			return Ack
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive := func(want string) {
+		t.Helper()
+		select {
+		case body := <-got:
+			if body != want {
+				t.Errorf("got %q, want %q", body, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%q not delivered", want)
+		}
+	}
+	if err := PublishJSON(m, "ex", "work", "before"); err != nil {
+		t.Fatal(err)
+	}
+	receive("before")
+
+	b.Restart()
+	if err := PublishJSON(m, "ex", "work", "after"); err != nil {
+		t.Fatalf("publish after restart: %v", err)
+	}
+	receive("after")
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sub.Wait(); err != nil {
+		t.Errorf("subscription: %v", err)
+	}
+	want := []ConnState{StateDisconnected, StateReconnecting, StateConnected, StateClosed}
+	for i, w := range want {
+		select {
+		case s := <-states:
+			if s != w {
+				t.Fatalf("state %d is %v, want %v", i, s, w)
+			}
+		default:
+			t.Fatalf("state %d missing, want %v", i, w)
+		}
+	}
+	select {
+	case s := <-states:
+		t.Errorf("unexpected state %v", s)
+	default:
+	}
+}
@@ -0,0 +1,148 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// HeaderAttempts counts how many times a message has been handed back by
+// a handler under a RetryPolicy.
+const HeaderAttempts = "x-peril-attempts"
+
+// HeaderOriginalExchange and HeaderOriginalRoutingKey remember where a
+// retried message was first published, since retries go through the
+// default exchange.
+const (
+	HeaderOriginalExchange   = "x-peril-original-exchange"
+	HeaderOriginalRoutingKey = "x-peril-original-routing-key"
+)
+
+// RetryPolicy replaces NackRequeue's immediate requeue with a delayed one.
+// The message is republished to a per-delay queue whose TTL dead-letters
+// it back to the original queue, with the delay growing exponentially.
+// Once MaxAttempts handlers have rejected it, it is nacked without requeue
+// and lands in the queue's dead letter exchange.
+type RetryPolicy struct {
+	MaxAttempts  int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:  5,
+	InitialDelay: time.Second,
+	MaxDelay:     time.Minute,
+}
+
+// WithRetry makes NackRequeue follow p instead of requeueing at once. Only
+// use it on durable queues: a retried message comes back through the
+// default exchange and is dropped if its queue is gone by then.
+func WithRetry(p RetryPolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.retry = &p
+	}
+}
+
+// Delay is how long to wait before the attempt after attempt number n.
+func (p RetryPolicy) Delay(n int) time.Duration {
+	d := p.InitialDelay
+	for i := 1; i < n; i++ {
+		d *= 2
+		if p.MaxDelay > 0 && d >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	return d
+}
+
+type retrier struct {
+	policy RetryPolicy
+	queue  string
+}
+
+func newRetrier(p RetryPolicy, queue string) *retrier {
+	return &retrier{policy: p, queue: queue}
+}
+
+// DelayQueueName is the queue that holds messages from queue for delay.
+// Delay queues used to be named <queue>.retry.<ms> and never expired; any
+// of those left on a broker can be deleted once they are empty.
+func DelayQueueName(queue string, delay time.Duration) string {
+	return fmt.Sprintf("%s.delay.%d", queue, delay.Milliseconds())
+}
+
+// delayQueueGrace is how long a delay queue outlives its delay once
+// nothing is retried through it.
+const delayQueueGrace = time.Minute
+
+// retry settles a delivery its handler asked to requeue.
+func (r *retrier) retry(ch Channel, d amqp.Delivery) {
+	attempts, _ := headerInt(d.Headers, HeaderAttempts)
+	attempts++
+	if attempts >= r.policy.MaxAttempts {
+		log.Printf("%s %s from %s: giving up after %d attempts",
+			d.Type, d.MessageId, r.queue, attempts)
+		d.Nack(false, false)
+		return
+	}
+	delay := r.policy.Delay(attempts)
+	delayQueue, err := r.declare(ch, delay)
+	if err == nil {
+		err = ch.PublishWithContext(context.Background(), "", delayQueue, false, false,
+			retryPublishing(d, attempts))
+	}
+	if err != nil {
+		log.Printf("could not schedule retry of %s from %s, requeueing: %v", d.MessageId, r.queue, err)
+		d.Nack(false, true)
+		return
+	}
+	d.Ack(false)
+}
+
+// declare declares the delay queue before every retry through it: that
+// resets its x-expires timer, so it outlives every message put in it but
+// goes away once the subscription stops retrying.
+func (r *retrier) declare(ch Channel, delay time.Duration) (string, error) {
+	name := DelayQueueName(r.queue, delay)
+	_, err := ch.QueueDeclare(name, true, false, false, false, amqp.Table{
+		"x-message-ttl":             delay.Milliseconds(),
+		"x-expires":                 (delay + delayQueueGrace).Milliseconds(),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": r.queue,
+	})
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func retryPublishing(d amqp.Delivery, attempts int) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[HeaderAttempts] = int32(attempts)
+	if _, ok := headers[HeaderOriginalExchange]; !ok {
+		headers[HeaderOriginalExchange] = d.Exchange
+		headers[HeaderOriginalRoutingKey] = d.RoutingKey
+	}
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		UserId:          d.UserId,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
@@ -0,0 +1,59 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRetryThroughDelayQueue(t *testing.T) {
+	b := NewMemoryBroker()
+	ch := deadLetterSetup(t, b)
+	if err := ch.ExchangeDeclare("ex", amqp.ExchangeDirect, false, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	policy := RetryPolicy{MaxAttempts: 3, InitialDelay: 10 * time.Millisecond, MaxDelay: 20 * time.Millisecond}
+	attempts := make(chan int, 4)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := SubscribeMessage(ctx, b, "ex", "work", "work", Durable,
+		func(msg Message[string]) Acktype {
+			attempts <- msg.Attempts
+			return NackRequeue
+		}, WithRetry(policy), WithQueueOptions(QueueOptions{DeadLetterExchange: "dlx"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PublishJSON(ch, "ex", "work", "again"); err != nil {
+		t.Fatal(err)
+	}
+	for want := 0; want < policy.MaxAttempts; want++ {
+		select {
+		case got := <-attempts:
+			if got != want {
+				t.Fatalf("attempt %d delivered with Attempts %d", want, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("attempt %d never delivered", want)
+		}
+	}
+	// The last rejection gives up and dead-letters the message.
+	deadline := time.Now().Add(2 * time.Second)
+	var dead []string
+	for len(dead) == 0 && time.Now().Before(deadline) {
+		dead = drain(t, ch, "dlq")
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(dead) != 1 {
+		t.Fatalf("dead-lettered %q after the last attempt, want the message", dead)
+	}
+	q, err := ch.QueueDeclarePassive(DelayQueueName("work", policy.Delay(1)), true, false, false, false, nil)
+	if err != nil {
+		t.Fatalf("delay queue: %v", err)
+	}
+	if q.Messages != 0 {
+		t.Errorf("delay queue still holds %d messages", q.Messages)
+	}
+}
@@ -0,0 +1,245 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Headers of a signed message. The signature covers the routing key it
+// was first published under, the content type, the message ID, the
+// timestamp to the second and the body.
+const (
+	HeaderSigner    = "x-peril-signer"
+	HeaderSignature = "x-peril-signature"
+	HeaderPublicKey = "x-peril-public-key"
+)
+
+// A signed message is only accepted while it is fresh: no older than
+// MaxMessageAge, and no further ahead of the local clock than
+// MaxClockSkew. MaxMessageAge has to outlast the retry delays of the
+// queues Verify guards.
+const (
+	MaxMessageAge = 10 * time.Minute
+	MaxClockSkew  = time.Minute
+)
+
+var (
+	ErrUnsigned   = errors.New("message is not signed")
+	ErrBadSigner  = errors.New("unknown signer")
+	ErrForged     = errors.New("signature does not match")
+	ErrImpersonal = errors.New("signer does not own the routing key")
+	ErrStale      = errors.New("message is too old or too far in the future")
+	ErrReplayed   = errors.New("message was already handled")
+)
+
+// Signer is the identity a process signs its messages with.
+type Signer struct {
+	Name string
+	Key  ed25519.PrivateKey
+}
+
+type signed struct {
+	Publisher
+	s Signer
+}
+
+// Signed signs everything published through pub as s. The public key goes
+// along too, so a KeyStore can learn it the first time it sees s. Messages
+// without an ID or timestamp get them here, since the signature covers
+// both.
+func Signed(pub Publisher, s Signer) Publisher {
+	return signed{Publisher: pub, s: s}
+}
+
+func (p signed) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	if msg.MessageId == "" {
+		msg.MessageId = newMessageID()
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now().UTC()
+	}
+	sig := ed25519.Sign(p.s.Key, signedBytes(key, msg.ContentType, msg.MessageId, msg.Timestamp, msg.Body))
+	headers[HeaderSigner] = p.s.Name
+	headers[HeaderSignature] = base64.StdEncoding.EncodeToString(sig)
+	headers[HeaderPublicKey] = base64.StdEncoding.EncodeToString(p.s.Key.Public().(ed25519.PublicKey))
+	msg.Headers = headers
+	return p.Publisher.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+}
+
+// signedBytes joins what a signature covers. AMQP timestamps only carry
+// whole seconds, so that is all that is signed.
+func signedBytes(key, contentType, messageID string, ts time.Time, body []byte) []byte {
+	b := make([]byte, 0, len(key)+len(contentType)+len(messageID)+len(body)+24)
+	b = append(b, key...)
+	b = append(b, 0)
+	b = append(b, contentType...)
+	b = append(b, 0)
+	b = append(b, messageID...)
+	b = append(b, 0)
+	b = strconv.AppendInt(b, ts.Unix(), 10)
+	b = append(b, 0)
+	return append(b, body...)
+}
+
+// SignedKey is the routing key the message was signed under: the one it
+// was first published with, even after a retry or dead lettering.
+func (md Metadata) SignedKey() string {
+	if key, ok := md.Headers[HeaderOriginalRoutingKey].(string); ok {
+		return key
+	}
+	return md.RoutingKey
+}
+
+// Signature returns who md claims to be signed by and the public key it
+// offers.
+func (md Metadata) Signature() (signer string, offered ed25519.PublicKey, err error) {
+	signer, _ = md.Headers[HeaderSigner].(string)
+	if signer == "" {
+		return "", nil, ErrUnsigned
+	}
+	if s, ok := md.Headers[HeaderPublicKey].(string); ok {
+		offered, _ = base64.StdEncoding.DecodeString(s)
+	}
+	return signer, offered, nil
+}
+
+// CheckSignature reports whether md is signed by the holder of pub.
+func CheckSignature(md Metadata, pub ed25519.PublicKey) error {
+	s, _ := md.Headers[HeaderSignature].(string)
+	sig, err := base64.StdEncoding.DecodeString(s)
+	if s == "" || err != nil {
+		return ErrUnsigned
+	}
+	if len(pub) != ed25519.PublicKeySize ||
+		!ed25519.Verify(pub, signedBytes(md.SignedKey(), md.ContentType, md.MessageID, md.Timestamp, md.Raw), sig) {
+		return ErrForged
+	}
+	return nil
+}
+
+type KeyStore interface {
+	PublicKey(name string) (ed25519.PublicKey, bool)
+}
+
+// Owner says whose routing key md was signed under, such as "alice" for
+// game_logs.alice. It should read md.SignedKey, not md.RoutingKey.
+type Owner func(md Metadata) (string, bool)
+
+// VerifySigner checks md's signature against keys, that md is fresh and
+// that the signer is owner of the routing key or one of trusted, and
+// returns the signer. A nil owner owns no keys, so only trusted signers
+// get through.
+func VerifySigner(md Metadata, keys KeyStore, owner Owner, trusted ...string) (string, error) {
+	signer, _, err := md.Signature()
+	if err != nil {
+		return "", err
+	}
+	pub, ok := keys.PublicKey(signer)
+	if !ok {
+		return signer, ErrBadSigner
+	}
+	if err := CheckSignature(md, pub); err != nil {
+		return signer, err
+	}
+	if age := time.Since(md.Timestamp); md.MessageID == "" || age > MaxMessageAge || age < -MaxClockSkew {
+		return signer, ErrStale
+	}
+	for _, t := range trusted {
+		if signer == t {
+			return signer, nil
+		}
+	}
+	if owner == nil {
+		return signer, ErrImpersonal
+	}
+	if name, ok := owner(md); !ok || name != signer {
+		return signer, ErrImpersonal
+	}
+	return signer, nil
+}
+
+// Verify discards messages that VerifySigner rejects, so they end up in
+// the dead letter queue rather than in front of the handler. It also
+// discards a message the handler has already acknowledged, so a captured
+// message cannot be sent again while it is still fresh. One the handler
+// requeued or discarded may come back, from a retry or a replay of the
+// dead letter queue.
+func Verify(keys KeyStore, owner Owner, trusted ...string) Middleware {
+	seen := newReplayCache()
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, md Metadata) Acktype {
+			signer, err := VerifySigner(md, keys, owner, trusted...)
+			if err == nil && !seen.add(signer, md.MessageID, md.Timestamp) {
+				err = ErrReplayed
+			}
+			if err != nil {
+				log.Printf("rejecting %s %s from %s: %v", md.Type, md.MessageID, describeSigner(signer), err)
+				return NackDiscard
+			}
+			ack := next(ctx, md)
+			if ack != Ack {
+				seen.remove(signer, md.MessageID)
+			}
+			return ack
+		}
+	}
+}
+
+// replayCache remembers the messages Verify let through until they are
+// too old to pass VerifySigner anyway.
+type replayCache struct {
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{seen: map[string]time.Time{}, pruned: time.Now()}
+}
+
+// add records the message and reports whether it is new.
+func (c *replayCache) add(signer, id string, ts time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.pruned) > MaxMessageAge {
+		for k, t := range c.seen {
+			if now.Sub(t) > MaxMessageAge {
+				delete(c.seen, k)
+			}
+		}
+		c.pruned = now
+	}
+	k := signer + "\x00" + id
+	if _, ok := c.seen[k]; ok {
+		return false
+	}
+	c.seen[k] = ts
+	return true
+}
+
+func (c *replayCache) remove(signer, id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.seen, signer+"\x00"+id)
+}
+
+func describeSigner(signer string) string {
+	if signer == "" {
+		return "unsigned sender"
+	}
+	return fmt.Sprintf("%q", signer)
+}
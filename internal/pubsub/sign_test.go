@@ -0,0 +1,216 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// capture keeps the last message published through it.
+type capture struct{ msg amqp.Publishing }
+
+func (c *capture) PublishWithContext(_ context.Context, _, _ string, _, _ bool, msg amqp.Publishing) error {
+	c.msg = msg
+	return nil
+}
+
+type keyMap map[string]ed25519.PublicKey
+
+func (k keyMap) PublicKey(name string) (ed25519.PublicKey, bool) {
+	pub, ok := k[name]
+	return pub, ok
+}
+
+func newSigner(t *testing.T, name string) Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Signer{Name: name, Key: key}
+}
+
+// signedMetadata signs msg as s under key and returns it as a delivery
+// would see it.
+func signedMetadata(t *testing.T, s Signer, key string, msg amqp.Publishing) Metadata {
+	t.Helper()
+	var c capture
+	if err := Signed(&c, s).PublishWithContext(context.Background(), "ex", key, false, false, msg); err != nil {
+		t.Fatal(err)
+	}
+	return Metadata{
+		MessageID:   c.msg.MessageId,
+		ContentType: c.msg.ContentType,
+		Timestamp:   c.msg.Timestamp.Truncate(time.Second),
+		RoutingKey:  key,
+		Headers:     c.msg.Headers,
+		Raw:         c.msg.Body,
+	}
+}
+
+func ownedBy(name string) Owner {
+	return func(Metadata) (string, bool) { return name, true }
+}
+
+func TestVerifySigner(t *testing.T) {
+	bob := newSigner(t, "bob")
+	keys := keyMap{"bob": bob.Key.Public().(ed25519.PublicKey)}
+	body := amqp.Publishing{ContentType: ContentTypeJSON, Body: []byte(`{"n":1}`)}
+	fresh := signedMetadata(t, bob, "intents.bob", body)
+
+	tests := []struct {
+		name  string
+		md    func(md Metadata) Metadata
+		owner Owner
+		want  error
+	}{
+		{"valid", func(md Metadata) Metadata { return md }, ownedBy("bob"), nil},
+		{"other owner", func(md Metadata) Metadata { return md }, ownedBy("alice"), ErrImpersonal},
+		{"no owner", func(md Metadata) Metadata { return md }, nil, ErrImpersonal},
+		{"body changed", func(md Metadata) Metadata { md.Raw = []byte(`{"n":2}`); return md }, ownedBy("bob"), ErrForged},
+		{"id changed", func(md Metadata) Metadata { md.MessageID = "other"; return md }, ownedBy("bob"), ErrForged},
+		{"timestamp changed", func(md Metadata) Metadata { md.Timestamp = md.Timestamp.Add(time.Second); return md }, ownedBy("bob"), ErrForged},
+		{"unsigned", func(md Metadata) Metadata { md.Headers = nil; return md }, ownedBy("bob"), ErrUnsigned},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := VerifySigner(tt.md(fresh), keys, tt.owner); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	if _, err := VerifySigner(fresh, keys, nil, "bob"); err != nil {
+		t.Errorf("trusted signer without an owner: %v", err)
+	}
+
+	for name, ts := range map[string]time.Time{
+		"stale":  time.Now().Add(-MaxMessageAge - time.Minute),
+		"future": time.Now().Add(MaxClockSkew + time.Minute),
+	} {
+		msg := body
+		msg.Timestamp = ts
+		md := signedMetadata(t, bob, "intents.bob", msg)
+		if _, err := VerifySigner(md, keys, ownedBy("bob")); !errors.Is(err, ErrStale) {
+			t.Errorf("%s: got %v, want %v", name, err, ErrStale)
+		}
+	}
+}
+
+func TestVerifyRejectsReplays(t *testing.T) {
+	bob := newSigner(t, "bob")
+	keys := keyMap{"bob": bob.Key.Public().(ed25519.PublicKey)}
+	md := signedMetadata(t, bob, "intents.bob", amqp.Publishing{ContentType: ContentTypeJSON, Body: []byte("{}")})
+
+	answer := NackRequeue
+	calls := 0
+	h := Verify(keys, ownedBy("bob"))(func(context.Context, Metadata) Acktype {
+		calls++
+		return answer
+	})
+	// A retry of the same message is not a replay.
+	if got := h(context.Background(), md); got != NackRequeue {
+		t.Fatalf("first delivery: %v", got)
+	}
+	answer = Ack
+	if got := h(context.Background(), md); got != Ack {
+		t.Fatalf("retry: %v", got)
+	}
+	if got := h(context.Background(), md); got != NackDiscard {
+		t.Errorf("replay: %v, want NackDiscard", got)
+	}
+	if calls != 2 {
+		t.Errorf("handler ran %d times, want 2", calls)
+	}
+
+	// Nor is a message the handler discarded coming back from the dead
+	// letter queue.
+	md = signedMetadata(t, bob, "intents.bob", amqp.Publishing{ContentType: ContentTypeJSON, Body: []byte("{}")})
+	answer = NackDiscard
+	if got := h(context.Background(), md); got != NackDiscard {
+		t.Fatalf("first delivery: %v", got)
+	}
+	answer = Ack
+	if got := h(context.Background(), md); got != Ack {
+		t.Errorf("dead letter replay: %v, want Ack", got)
+	}
+	if calls != 4 {
+		t.Errorf("handler ran %d times, want 4", calls)
+	}
+}
+
+// TestVerifyAcceptsDeadLetterReplay discards a signed message into the
+// dead letter queue of a memory broker, replays it from there as the dlq
+// command does and expects Verify to let it through again.
+func TestVerifyAcceptsDeadLetterReplay(t *testing.T) {
+	bob := newSigner(t, "bob")
+	keys := keyMap{"bob": bob.Key.Public().(ed25519.PublicKey)}
+	b := NewMemoryBroker()
+	ch := deadLetterSetup(t, b)
+	if err := ch.ExchangeDeclare("ex", amqp.ExchangeTopic, true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	handled := make(chan Acktype, 4)
+	answers := make(chan Acktype, 4)
+	answers <- NackDiscard
+	answers <- Ack
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := SubscribeMessage(ctx, b, "ex", "intents", "intents.*", Durable,
+		func(msg Message[string]) Acktype {
+			ack := <-answers
+			handled <- ack
+			return ack
+		}, WithQueueOptions(QueueOptions{DeadLetterExchange: "dlx"}),
+		WithMiddleware(Verify(keys, ownedBy("bob"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PublishJSON(Signed(ch, bob), "ex", "intents.bob", "attack"); err != nil {
+		t.Fatal(err)
+	}
+	expect := func(want Acktype) {
+		t.Helper()
+		select {
+		case got := <-handled:
+			if got != want {
+				t.Fatalf("handler answered %v, want %v", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("message not handled")
+		}
+	}
+	expect(NackDiscard)
+
+	var d amqp.Delivery
+	deadline := time.Now().Add(2 * time.Second)
+	for ok := false; !ok; {
+		if time.Now().After(deadline) {
+			t.Fatal("message not dead-lettered")
+		}
+		time.Sleep(10 * time.Millisecond)
+		if d, ok, err = ch.Get("dlq", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dl := ParseDeadLetter(d)
+	if dl.Queue != "intents" || dl.OriginalRoutingKey != "intents.bob" {
+		t.Fatalf("dead letter from %q under %q", dl.Queue, dl.OriginalRoutingKey)
+	}
+	if err := dl.Replay(context.Background(), ch); err != nil {
+		t.Fatal(err)
+	}
+	if err := dl.Ack(false); err != nil {
+		t.Fatal(err)
+	}
+	expect(Ack)
+	time.Sleep(50 * time.Millisecond)
+	if dead := drain(t, ch, "dlq"); len(dead) != 0 {
+		t.Errorf("replay dead-lettered again: %q", dead)
+	}
+}
@@ -0,0 +1,299 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var ErrSubscriptionLost = errors.New("pubsub: subscription lost")
+
+// Subscription is a consumer started by Subscribe. It runs until its
+// context is cancelled, Close is called, or the broker goes away for good.
+type Subscription struct {
+	queue  string
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// Close stops consuming and waits for the subscription to shut down:
+// the consumer is cancelled, the handler in progress finishes and settles
+// its message, deliveries that were never started go back to the queue,
+// and the channel is closed.
+func (s *Subscription) Close() error {
+	s.cancel()
+	return s.Wait()
+}
+
+// Wait blocks until the subscription has stopped. It returns
+// ErrSubscriptionLost if the delivery channel closed and the broker could
+// not resubscribe.
+func (s *Subscription) Wait() error {
+	<-s.done
+	return s.err
+}
+
+// Done is closed once the subscription has stopped.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+type consumerSpec struct {
+	conn      Broker
+	exchange  string
+	queueName string
+	key       string
+	queueType SimpleQueueType
+	opts      subscribeOptions
+}
+
+type subscribeOptions struct {
+	prefetch     int
+	workers      int
+	ordered      bool
+	defaultCodec Codec
+	middleware   []Middleware
+	retry        *RetryPolicy
+	queue        QueueOptions
+	deadLetter   string
+}
+
+type SubscribeOption func(*subscribeOptions)
+
+// WithPrefetch sets how many unacked deliveries the broker may push to
+// the subscription at once. It is raised to the worker count if lower.
+func WithPrefetch(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.prefetch = n
+	}
+}
+
+// WithWorkers runs n handlers in parallel.
+func WithWorkers(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.workers = n
+	}
+}
+
+// WithOrderedKeys keeps deliveries that share a routing key on the same
+// worker, so they are handled in the order they arrived.
+func WithOrderedKeys() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.ordered = true
+	}
+}
+
+// WithDefaultCodec decodes deliveries that carry no content type with c.
+// Deliveries with a content type always use the registered codec for it.
+func WithDefaultCodec(c Codec) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.defaultCodec = c
+	}
+}
+
+func newSubscribeOptions(opts []SubscribeOption) subscribeOptions {
+	o := subscribeOptions{prefetch: 10, workers: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.workers < 1 {
+		o.workers = 1
+	}
+	if o.prefetch < o.workers {
+		o.prefetch = o.workers
+	}
+	if o.queue.DeadLetterExchange == "" {
+		o.queue.DeadLetterExchange = o.deadLetter
+	}
+	return o
+}
+
+func startSubscription(ctx context.Context, spec consumerSpec,
+	handle func(Channel, amqp.Delivery)) (*Subscription, error) {
+	ch, deliveries, tag, err := spec.open()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Subscription{
+		queue:  spec.queueName,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go s.run(ctx, spec, ch, deliveries, tag, handle)
+	return s, nil
+}
+
+func (spec consumerSpec) open() (Channel, <-chan amqp.Delivery, string, error) {
+	ch, _, err := declareAndBind(spec.conn, spec.exchange, spec.queueName, spec.key,
+		spec.queueType, spec.opts.queue)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if err := ch.Qos(spec.opts.prefetch, 0, false); err != nil {
+		ch.Close()
+		return nil, nil, "", err
+	}
+	tag := "peril-" + newMessageID()
+	deliveries, err := ch.Consume(spec.queueName, tag, false, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, nil, "", err
+	}
+	return ch, deliveries, tag, nil
+}
+
+// reopen waits for the broker to come back and declares, binds and
+// consumes from the queue again. It reports false once the broker is
+// closed for good or ctx is cancelled.
+func (spec consumerSpec) reopen(ctx context.Context, r reconnector) (Channel, <-chan amqp.Delivery, string, bool) {
+	select {
+	case <-r.Done():
+		return nil, nil, "", false
+	default:
+	}
+	log.Printf("subscription to %s lost, waiting to resubscribe", spec.queueName)
+	delay := DefaultBackoff.Initial
+	for {
+		select {
+		case <-r.Ready():
+		case <-r.Done():
+			return nil, nil, "", false
+		case <-ctx.Done():
+			return nil, nil, "", false
+		}
+		ch, deliveries, tag, err := spec.open()
+		if err == nil {
+			log.Printf("resubscribed to %s", spec.queueName)
+			return ch, deliveries, tag, true
+		}
+		log.Printf("resubscribe to %s failed: %v", spec.queueName, err)
+		select {
+		case <-time.After(delay):
+		case <-r.Done():
+			return nil, nil, "", false
+		case <-ctx.Done():
+			return nil, nil, "", false
+		}
+		delay = DefaultBackoff.next(delay)
+	}
+}
+
+func (s *Subscription) run(ctx context.Context, spec consumerSpec, ch Channel,
+	deliveries <-chan amqp.Delivery, tag string, handle func(Channel, amqp.Delivery)) {
+	defer close(s.done)
+	defer s.cancel()
+	for {
+		if s.consume(ctx, spec, ch, deliveries, tag, handle) {
+			return
+		}
+		ch.Close()
+		r, ok := spec.conn.(reconnector)
+		if !ok {
+			s.err = ErrSubscriptionLost
+			return
+		}
+		ch, deliveries, tag, ok = spec.reopen(ctx, r)
+		if !ok {
+			return
+		}
+	}
+}
+
+// consume hands deliveries to the worker pool. It reports true when it
+// stopped because ctx was cancelled and false when the delivery channel
+// closed underneath it. Either way every handler it started has returned.
+//
+// Each handler settles its own delivery by tag with multiple=false, so
+// workers finishing out of order never ack a message that is still being
+// handled elsewhere.
+func (s *Subscription) consume(ctx context.Context, spec consumerSpec, ch Channel,
+	deliveries <-chan amqp.Delivery, tag string, handle func(Channel, amqp.Delivery)) bool {
+	pool := newWorkerPool(spec.opts, func(d amqp.Delivery) { handle(ch, d) })
+	defer pool.stop()
+	for {
+		if ctx.Err() != nil {
+			s.shutdown(ch, deliveries, tag, pool)
+			return true
+		}
+		select {
+		case <-ctx.Done():
+		case d, ok := <-deliveries:
+			if !ok {
+				return false
+			}
+			pool.dispatch(d)
+		}
+	}
+}
+
+type workerPool struct {
+	jobs    []chan amqp.Delivery
+	ordered bool
+	wg      sync.WaitGroup
+	stopped bool
+}
+
+func newWorkerPool(opts subscribeOptions, handle func(amqp.Delivery)) *workerPool {
+	p := &workerPool{ordered: opts.ordered}
+	shared := make(chan amqp.Delivery)
+	for i := 0; i < opts.workers; i++ {
+		jobs := shared
+		if opts.ordered {
+			jobs = make(chan amqp.Delivery)
+		}
+		p.jobs = append(p.jobs, jobs)
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for d := range jobs {
+				handle(d)
+			}
+		}()
+	}
+	if !opts.ordered {
+		p.jobs = p.jobs[:1]
+	}
+	return p
+}
+
+func (p *workerPool) dispatch(d amqp.Delivery) {
+	if !p.ordered {
+		p.jobs[0] <- d
+		return
+	}
+	h := fnv.New32a()
+	h.Write([]byte(d.RoutingKey))
+	p.jobs[h.Sum32()%uint32(len(p.jobs))] <- d
+}
+
+// stop lets every worker finish its current delivery and exit.
+func (p *workerPool) stop() {
+	if p.stopped {
+		return
+	}
+	p.stopped = true
+	for _, jobs := range p.jobs {
+		close(jobs)
+	}
+	p.wg.Wait()
+}
+
+// shutdown sends basic.cancel so the broker stops delivering, requeues
+// whatever had already been pushed to us but not started, waits for the
+// handlers in flight to settle their messages and closes the channel.
+func (s *Subscription) shutdown(ch Channel, deliveries <-chan amqp.Delivery, tag string, pool *workerPool) {
+	if err := ch.Cancel(tag, false); err == nil {
+		for d := range deliveries {
+			d.Nack(false, true)
+		}
+	}
+	pool.stop()
+	ch.Close()
+}
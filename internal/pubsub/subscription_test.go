@@ -0,0 +1,237 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// workQueue declares a direct exchange ex and returns a channel on b to
+// publish and inspect queues with.
+func workQueue(t *testing.T, b *MemoryBroker) Channel {
+	t.Helper()
+	ch := memChannelFor(t, b)
+	if err := ch.ExchangeDeclare("ex", amqp.ExchangeDirect, true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	return ch
+}
+
+func ready(t *testing.T, ch Channel, queue string) int {
+	t.Helper()
+	q, err := ch.QueueDeclarePassive(queue, true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q.Messages
+}
+
+func TestSubscriptionCloseSettlesEverything(t *testing.T) {
+	const published = 10
+	b := NewMemoryBroker()
+	ch := workQueue(t, b)
+	if _, err := DeclareQueue(ch, "work", Durable, QueueOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("work", "work", "ex", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < published; i++ {
+		if err := PublishJSON(ch, "ex", "work", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var acked atomic.Int32
+	started := make(chan struct{}, published)
+	release := make(chan struct{})
+	sub, err := SubscribeMessage(context.Background(), b, "ex", "work", "work", Durable,
+		func(msg Message[int]) Acktype {
+			started <- struct{}{}
+			<-release
+			acked.Add(1)
+			return Ack
+		}, WithWorkers(2), WithPrefetch(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(2 * time.Second):
+			t.Fatal("handlers never started")
+		}
+	}
+
+	closed := make(chan error)
+	go func() { closed <- sub.Close() }()
+	select {
+	case err := <-closed:
+		t.Fatalf("Close returned %v while handlers were still running", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close did not return")
+	}
+
+	n := int(acked.Load())
+	if n < 2 {
+		t.Errorf("acked %d, want the handlers in flight to finish", n)
+	}
+	if left := ready(t, ch, "work"); n+left != published {
+		t.Errorf("acked %d and %d left in the queue, want %d in all", n, left, published)
+	}
+}
+
+func TestSubscriptionStopsOnCancel(t *testing.T) {
+	b := NewMemoryBroker()
+	ch := workQueue(t, b)
+	got := make(chan string, 4)
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err := SubscribeMessage(ctx, b, "ex", "work", "work", Durable,
+		func(msg Message[string]) Acktype {
+			got <- msg.Body
+			return Ack
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PublishJSON(ch, "ex", "work", "first"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-got:
+	case <-time.After(2 * time.Second):
+		t.Fatal("first message not delivered")
+	}
+
+	cancel()
+	select {
+	case <-sub.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscription still running after cancel")
+	}
+	if err := sub.Wait(); err != nil {
+		t.Error(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := PublishJSON(ch, "ex", "work", fmt.Sprint("late ", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case body := <-got:
+		t.Errorf("%q consumed after cancel", body)
+	default:
+	}
+	if left := ready(t, ch, "work"); left != 3 {
+		t.Errorf("%d messages left in the queue, want 3", left)
+	}
+}
+
+func TestSubscribeOptions(t *testing.T) {
+	tests := []struct {
+		name              string
+		opts              []SubscribeOption
+		workers, prefetch int
+	}{
+		{"defaults", nil, 1, 10},
+		{"workers", []SubscribeOption{WithWorkers(4)}, 4, 10},
+		{"prefetch below workers", []SubscribeOption{WithWorkers(4), WithPrefetch(1)}, 4, 4},
+		{"no workers", []SubscribeOption{WithWorkers(0), WithPrefetch(3)}, 1, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newSubscribeOptions(tt.opts)
+			if o.workers != tt.workers || o.prefetch != tt.prefetch {
+				t.Errorf("workers %d prefetch %d, want %d and %d", o.workers, o.prefetch, tt.workers, tt.prefetch)
+			}
+		})
+	}
+}
+
+// TestOrderedKeys interleaves several routing keys through a pool of
+// workers: each key must be handled in publish order, and different keys
+// must be handled at the same time.
+func TestOrderedKeys(t *testing.T) {
+	const keys, perKey = 8, 10
+	b := NewMemoryBroker()
+	ch := memChannelFor(t, b)
+	if err := ch.ExchangeDeclare("ex", amqp.ExchangeTopic, false, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	type step struct {
+		Key string
+		Seq int
+	}
+	var (
+		mu        sync.Mutex
+		seen      = map[string][]int{}
+		inFlight  int
+		maxFlight int
+	)
+	done := make(chan struct{}, keys*perKey)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := SubscribeMessage(ctx, b, "ex", "work", "work.*", Transient,
+		func(msg Message[step]) Acktype {
+			mu.Lock()
+			inFlight++
+			maxFlight = max(maxFlight, inFlight)
+			mu.Unlock()
+			time.Sleep(2 * time.Millisecond)
+			mu.Lock()
+			inFlight--
+			seen[msg.Body.Key] = append(seen[msg.Body.Key], msg.Body.Seq)
+			mu.Unlock()
+			done <- struct{}{}
+			return Ack
+		}, WithWorkers(4), WithOrderedKeys(), WithPrefetch(keys*perKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seq := 0; seq < perKey; seq++ {
+		for k := 0; k < keys; k++ {
+			key := fmt.Sprint("work.", k)
+			if err := PublishJSON(ch, "ex", key, step{key, seq}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < keys*perKey; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d messages handled", i, keys*perKey)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != keys {
+		t.Errorf("handled %d keys, want %d", len(seen), keys)
+	}
+	for key, seqs := range seen {
+		for i, seq := range seqs {
+			if seq != i {
+				t.Errorf("%s handled in order %v", key, seqs)
+				break
+			}
+		}
+	}
+	if maxFlight < 2 {
+		t.Errorf("at most %d handlers ran at once, want the workers to overlap", maxFlight)
+	}
+}
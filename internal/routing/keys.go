@@ -0,0 +1,114 @@
+package routing
+
+import "strings"
+
+// Binding patterns for the per-player keys below.
+const (
+	ArmyMovesPattern       = ArmyMovesPrefix + ".*"
+	WarRecognitionsPattern = WarRecognitionsPrefix + ".*"
+	GameLogPattern         = GameLogSlug + ".*"
+	IntentsPattern         = IntentsPrefix + ".*"
+	WarResolvedPattern     = WarResolvedPrefix + ".*"
+	ModerationPattern      = ModerationPrefix + ".*"
+)
+
+// ArmyMoveKey is the key username's moves are published under.
+func ArmyMoveKey(username string) string {
+	return ArmyMovesPrefix + "." + username
+}
+
+// WarKey is the key a war declared by attacker is published under.
+func WarKey(attacker string) string {
+	return WarRecognitionsPrefix + "." + attacker
+}
+
+// WarResolvedKey is the key the outcome of a war declared by attacker is
+// published under.
+func WarResolvedKey(attacker string) string {
+	return WarResolvedPrefix + "." + attacker
+}
+
+// GameLogKey is the key username's game logs are published under.
+func GameLogKey(username string) string {
+	return GameLogSlug + "." + username
+}
+
+// IntentKey is the key username's intents are sent to the server under.
+func IntentKey(username string) string {
+	return IntentsPrefix + "." + username
+}
+
+// StateDeltaKey is the key the server answers username's intents under.
+func StateDeltaKey(username string) string {
+	return StateDeltasPrefix + "." + username
+}
+
+// ModerationKey is the key moderation events about username are
+// published under.
+func ModerationKey(username string) string {
+	return ModerationPrefix + "." + username
+}
+
+// PlayerQueue names username's own queue for messages under prefix, such
+// as "pause.alice".
+func PlayerQueue(prefix, username string) string {
+	return prefix + "." + username
+}
+
+func ParseArmyMoveKey(key string) (username string, ok bool) {
+	return parseKey(ArmyMovesPrefix, key)
+}
+
+func ParseWarKey(key string) (attacker string, ok bool) {
+	return parseKey(WarRecognitionsPrefix, key)
+}
+
+func ParseGameLogKey(key string) (username string, ok bool) {
+	return parseKey(GameLogSlug, key)
+}
+
+func ParseIntentKey(key string) (username string, ok bool) {
+	return parseKey(IntentsPrefix, key)
+}
+
+func parseKey(prefix, key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, prefix+".")
+	if !ok || rest == "" || strings.Contains(rest, ".") {
+		return "", false
+	}
+	return rest, true
+}
+
+// MatchTopic reports whether a topic exchange would route key to a queue
+// bound with pattern: words are separated by dots, "*" matches exactly one
+// word and "#" matches zero or more. Like RabbitMQ, it takes the empty key
+// to have no words at all.
+func MatchTopic(pattern, key string) bool {
+	return matchWords(topicWords(pattern), topicWords(key))
+}
+
+func topicWords(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ".")
+}
+
+func matchWords(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchWords(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchWords(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && matchWords(pattern[1:], words[1:])
+	}
+}
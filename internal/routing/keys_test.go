@@ -0,0 +1,120 @@
+package routing
+
+import "testing"
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"game_logs.bob", "game_logs.bob", true},
+		{"game_logs.bob", "game_logs.alice", false},
+		{"game_logs.bob", "game_logs", false},
+
+		{"army_moves.*", "army_moves.bob", true},
+		{"army_moves.*", "army_moves.bob.extra", false},
+		{"*.bob", "war.bob", true},
+		{"a.*.c", "a.b.c", true},
+
+		// * is exactly one word, never zero.
+		{"army_moves.*", "army_moves", false},
+		{"*", "", false},
+		{"a.*.c", "a.c", false},
+
+		// # at the end matches zero or more words.
+		{"game_logs.#", "game_logs", true},
+		{"game_logs.#", "game_logs.bob", true},
+		{"game_logs.#", "game_logs.bob.x.y", true},
+		{"game_logs.#", "other.bob", false},
+		{"#", "", true},
+		{"#", "anything.at.all", true},
+
+		// # in the middle or at the start.
+		{"a.#.z", "a.z", true},
+		{"a.#.z", "a.b.z", true},
+		{"a.#.z", "a.b.c.d.z", true},
+		{"a.#.z", "a.b.c", false},
+		{"#.z", "z", true},
+		{"#.z", "a.b.z", true},
+		{"#.z", "a.b.z.q", false},
+		{"a.#.#.z", "a.z", true},
+
+		// Mixed wildcards.
+		{"*.#", "", false},
+		{"*.#", "a", true},
+		{"#.*", "a.b.c", true},
+		{"a.*.#", "a", false},
+		{"a.*.#", "a.b", true},
+
+		{"", "", true},
+		{"", "a", false},
+	}
+	for _, tt := range tests {
+		if got := MatchTopic(tt.pattern, tt.key); got != tt.want {
+			t.Errorf("MatchTopic(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestKeyBuilders(t *testing.T) {
+	tests := []struct {
+		got, want string
+	}{
+		{ArmyMoveKey("bob"), "army_moves.bob"},
+		{WarKey("bob"), "war.bob"},
+		{WarResolvedKey("bob"), "war_resolved.bob"},
+		{GameLogKey("bob"), "game_logs.bob"},
+		{IntentKey("bob"), "intents.bob"},
+		{StateDeltaKey("bob"), "state.bob"},
+		{ModerationKey("bob"), "moderation.bob"},
+		{PlayerQueue(PauseKey, "bob"), "pause.bob"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("got %q, want %q", tt.got, tt.want)
+		}
+	}
+}
+
+// Every key a builder makes is matched by the binding pattern for it.
+func TestPatternsMatchKeys(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     func(string) string
+	}{
+		{ArmyMovesPattern, ArmyMoveKey},
+		{WarRecognitionsPattern, WarKey},
+		{WarResolvedPattern, WarResolvedKey},
+		{GameLogPattern, GameLogKey},
+		{IntentsPattern, IntentKey},
+		{ModerationPattern, ModerationKey},
+	}
+	for _, tt := range tests {
+		if key := tt.key("bob"); !MatchTopic(tt.pattern, key) {
+			t.Errorf("%q does not match %q", tt.pattern, key)
+		}
+	}
+	// War and war_resolved share a stem but not a pattern.
+	if MatchTopic(WarRecognitionsPattern, WarResolvedKey("bob")) {
+		t.Errorf("%q matches %q", WarRecognitionsPattern, WarResolvedKey("bob"))
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	parsers := map[string]func(string) (string, bool){
+		ArmyMovesPrefix:       ParseArmyMoveKey,
+		WarRecognitionsPrefix: ParseWarKey,
+		GameLogSlug:           ParseGameLogKey,
+		IntentsPrefix:         ParseIntentKey,
+	}
+	for prefix, parse := range parsers {
+		if user, ok := parse(prefix + ".bob"); !ok || user != "bob" {
+			t.Errorf("parse %s.bob = %q, %v", prefix, user, ok)
+		}
+		for _, bad := range []string{prefix, prefix + ".", prefix + ".bob.x", "other.bob", prefix + "x.bob", ""} {
+			if user, ok := parse(bad); ok {
+				t.Errorf("parse %q = %q, want no match", bad, user)
+			}
+		}
+	}
+}
@@ -11,3 +11,14 @@ type GameLog struct {
 	Message     string
 	Username    string
 }
+
+// Moderation flags a player whose game logs went over quota FlagAfter
+// times within a window. Strikes counts how often they have been flagged.
+type Moderation struct {
+	Username string
+	Reason   string
+	Dropped  int
+	Since    time.Time
+	Time     time.Time
+	Strikes  int
+}
@@ -5,13 +5,39 @@ const (
 
 	WarRecognitionsPrefix = "war"
 
+	WarResolvedPrefix = "war_resolved"
+
 	PauseKey = "pause"
 
 	GameLogSlug = "game_logs"
+
+	IntentsPrefix = "intents"
+
+	StateDeltasPrefix = "state"
+
+	ModerationPrefix = "moderation"
 )
 
+// Default exchange names. Processes use the ones in their Exchanges,
+// which config can rename.
 const (
 	ExchangePerilDirect = "peril_direct"
 	ExchangePerilTopic  = "peril_topic"
-	ExchangePerilDead    = "peril_dlx"
+	ExchangePerilDead   = "peril_dlx"
+)
+
+// Exchanges names the three Peril exchanges.
+type Exchanges struct {
+	Direct     string `json:"direct,omitempty"`
+	Topic      string `json:"topic,omitempty"`
+	DeadLetter string `json:"dead_letter,omitempty"`
+}
+
+// DefaultExchanges returns the default exchange names.
+func DefaultExchanges() Exchanges {
+	return Exchanges{Direct: ExchangePerilDirect, Topic: ExchangePerilTopic, DeadLetter: ExchangePerilDead}
+}
+
+const (
+	QueuePerilDead = "peril_dlq"
 )
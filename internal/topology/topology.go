@@ -0,0 +1,261 @@
+// Package topology declares the exchanges, queues, bindings and queue
+// policies Peril shares between processes. Per-player queues are still
+// declared by the subscriptions that use them.
+package topology
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/tdabry/learn-pub-sub-starter/internal/pubsub"
+	"github.com/tdabry/learn-pub-sub-starter/internal/routing"
+)
+
+type Exchange struct {
+	Name    string
+	Kind    string
+	Durable bool
+	Args    amqp.Table
+}
+
+// Queue options are what a queue needs to work, such as its dead letter
+// exchange. Limits an operator may want to tune, like lengths, go in a
+// Policy instead (see pubsub.Policy).
+type Queue struct {
+	Name       string
+	Durable    bool
+	AutoDelete bool
+	Options    pubsub.QueueOptions
+}
+
+type Binding struct {
+	Queue    string
+	Exchange string
+	Key      string
+}
+
+type Topology struct {
+	Exchanges []Exchange
+	Queues    []Queue
+	Bindings  []Binding
+	Policies  []pubsub.Policy
+}
+
+// GameLogs caps the server's queue of game logs so it stops growing while
+// the server is down. The oldest logs are dropped first, into the dead
+// letter queue. It is applied as the peril-game-logs policy.
+var GameLogs = pubsub.QueueOptions{
+	MaxLength:      10000,
+	MaxLengthBytes: 10 << 20,
+	Overflow:       pubsub.DropHead,
+}
+
+// DeadLetters caps the dead letter queue, as the peril-dead-letters
+// policy. It has no dead letter exchange of its own, so what it drops is
+// gone.
+var DeadLetters = pubsub.QueueOptions{
+	MaxLength: 10000,
+	Overflow:  pubsub.DropHead,
+}
+
+// Moderation keeps moderation events until a moderator reads them, up to
+// the limit of the peril-moderation policy.
+var Moderation = pubsub.QueueOptions{
+	MaxLength: 10000,
+	Overflow:  pubsub.DropHead,
+}
+
+// Peril is the topology both the server and the clients expect, under the
+// exchange names in ex. Every queue but the dead letter queue and the
+// moderation queue dead-letters to ex.DeadLetter. Their limits are not
+// queue arguments but the policies in Policies, which only Declare with a
+// PolicyAdmin sets; without one the queues are uncapped until an operator
+// adds them.
+func Peril(ex routing.Exchanges) Topology {
+	dlx := pubsub.QueueOptions{DeadLetterExchange: ex.DeadLetter}
+	return Topology{
+		Exchanges: []Exchange{
+			{Name: ex.Direct, Kind: amqp.ExchangeDirect, Durable: true},
+			{Name: ex.Topic, Kind: amqp.ExchangeTopic, Durable: true},
+			{Name: ex.DeadLetter, Kind: amqp.ExchangeFanout, Durable: true},
+		},
+		Queues: []Queue{
+			{Name: routing.QueuePerilDead, Durable: true},
+			{Name: routing.GameLogSlug, Durable: true, Options: dlx},
+			{Name: routing.IntentsPrefix, Durable: true, Options: dlx},
+			{Name: routing.WarRecognitionsPrefix, Durable: true, Options: dlx},
+			{Name: routing.ModerationPrefix, Durable: true},
+		},
+		Bindings: []Binding{
+			{Queue: routing.QueuePerilDead, Exchange: ex.DeadLetter, Key: ""},
+			{Queue: routing.GameLogSlug, Exchange: ex.Topic, Key: routing.GameLogPattern},
+			{Queue: routing.IntentsPrefix, Exchange: ex.Topic, Key: routing.IntentsPattern},
+			{Queue: routing.WarRecognitionsPrefix, Exchange: ex.Topic, Key: routing.WarRecognitionsPattern},
+			{Queue: routing.ModerationPrefix, Exchange: ex.Topic, Key: routing.ModerationPattern},
+		},
+		Policies: []pubsub.Policy{
+			{Name: "peril-game-logs", Pattern: queuePattern(routing.GameLogSlug), Queue: GameLogs},
+			{Name: "peril-dead-letters", Pattern: queuePattern(routing.QueuePerilDead), Queue: DeadLetters},
+			{Name: "peril-moderation", Pattern: queuePattern(routing.ModerationPrefix), Queue: Moderation},
+		},
+	}
+}
+
+// queuePattern is a policy pattern that matches only the queue name.
+func queuePattern(name string) string {
+	return "^" + regexp.QuoteMeta(name) + "$"
+}
+
+// Declare creates everything in t that the broker does not have yet. It
+// is idempotent, but fails if an existing exchange or queue was declared
+// with different settings. Policies are set through admin, and only the
+// missing ones, so an operator's changes to them stay; with a nil admin
+// they are left alone.
+func (t Topology) Declare(conn pubsub.Broker, admin pubsub.PolicyAdmin) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	for _, ex := range t.Exchanges {
+		if err := ch.ExchangeDeclare(ex.Name, ex.Kind, ex.Durable, false, false, false, ex.Args); err != nil {
+			return fmt.Errorf("declare exchange %s: %w", ex.Name, err)
+		}
+	}
+	for _, q := range t.Queues {
+		if _, err := ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, false, false, q.Options.Args()); err != nil {
+			return fmt.Errorf("declare queue %s: %w", q.Name, err)
+		}
+	}
+	for _, b := range t.Bindings {
+		if err := ch.QueueBind(b.Queue, b.Key, b.Exchange, false, nil); err != nil {
+			return fmt.Errorf("bind %s to %s with %q: %w", b.Queue, b.Exchange, b.Key, err)
+		}
+	}
+	if admin == nil {
+		return nil
+	}
+	have, err := policies(admin)
+	if err != nil {
+		return err
+	}
+	for _, p := range t.Policies {
+		if _, ok := have[p.Name]; ok {
+			continue
+		}
+		if err := admin.SetPolicy(p); err != nil {
+			return fmt.Errorf("set policy %s: %w", p.Name, err)
+		}
+	}
+	return nil
+}
+
+func policies(admin pubsub.PolicyAdmin) (map[string]pubsub.Policy, error) {
+	list, err := admin.Policies()
+	if err != nil {
+		return nil, fmt.Errorf("list policies: %w", err)
+	}
+	have := make(map[string]pubsub.Policy, len(list))
+	for _, p := range list {
+		have[p.Name] = p
+	}
+	return have, nil
+}
+
+// Difference is one way the broker disagrees with a Topology.
+type Difference struct {
+	Kind   string // "exchange", "queue" or "policy"
+	Name   string
+	Reason string // "missing", the broker's objection to redeclaring it, or how a policy differs
+}
+
+func (d Difference) String() string {
+	return fmt.Sprintf("%s %s: %s", d.Kind, d.Name, d.Reason)
+}
+
+// Diff compares t with the broker without changing anything it does not
+// already have. Missing exchanges and queues are found with passive
+// declares; existing ones are redeclared, which RabbitMQ refuses when
+// their settings differ. AMQP cannot list bindings, so they are not
+// compared; Declare adds any that are missing. Policies are compared
+// through admin, unless it is nil.
+func (t Topology) Diff(conn pubsub.Broker, admin pubsub.PolicyAdmin) ([]Difference, error) {
+	var diffs []Difference
+	for _, ex := range t.Exchanges {
+		d, err := check(conn, "exchange", ex.Name,
+			func(ch pubsub.Channel) error {
+				return ch.ExchangeDeclarePassive(ex.Name, ex.Kind, ex.Durable, false, false, false, nil)
+			},
+			func(ch pubsub.Channel) error {
+				return ch.ExchangeDeclare(ex.Name, ex.Kind, ex.Durable, false, false, false, ex.Args)
+			})
+		if err != nil {
+			return nil, err
+		}
+		if d != nil {
+			diffs = append(diffs, *d)
+		}
+	}
+	for _, q := range t.Queues {
+		d, err := check(conn, "queue", q.Name,
+			func(ch pubsub.Channel) error {
+				_, err := ch.QueueDeclarePassive(q.Name, q.Durable, q.AutoDelete, false, false, nil)
+				return err
+			},
+			func(ch pubsub.Channel) error {
+				_, err := ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, false, false, q.Options.Args())
+				return err
+			})
+		if err != nil {
+			return nil, err
+		}
+		if d != nil {
+			diffs = append(diffs, *d)
+		}
+	}
+	if admin == nil {
+		return diffs, nil
+	}
+	have, err := policies(admin)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range t.Policies {
+		got, ok := have[p.Name]
+		switch {
+		case !ok:
+			diffs = append(diffs, Difference{Kind: "policy", Name: p.Name, Reason: "missing"})
+		case got != p:
+			diffs = append(diffs, Difference{Kind: "policy", Name: p.Name,
+				Reason: fmt.Sprintf("is %s %v, want %s %v", got.Pattern, got.Queue.Args(), p.Pattern, p.Queue.Args())})
+		}
+	}
+	return diffs, nil
+}
+
+// check runs one passive and one real declare, each on its own channel
+// since a failed declare closes the channel it was made on.
+func check(conn pubsub.Broker, kind, name string, passive, declare func(pubsub.Channel) error) (*Difference, error) {
+	for i, step := range []func(pubsub.Channel) error{passive, declare} {
+		ch, err := conn.Channel()
+		if err != nil {
+			return nil, err
+		}
+		err = step(ch)
+		ch.Close()
+		var amqpErr *amqp.Error
+		switch {
+		case err == nil:
+			continue
+		case !errors.As(err, &amqpErr):
+			return nil, err
+		case i == 0 && amqpErr.Code == amqp.NotFound:
+			return &Difference{Kind: kind, Name: name, Reason: "missing"}, nil
+		default:
+			return &Difference{Kind: kind, Name: name, Reason: amqpErr.Reason}, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,149 @@
+package topology
+
+import (
+	"context"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/tdabry/learn-pub-sub-starter/internal/pubsub"
+	"github.com/tdabry/learn-pub-sub-starter/internal/routing"
+)
+
+func TestPerilUsesExchangeNames(t *testing.T) {
+	ex := routing.Exchanges{Direct: "d", Topic: "t", DeadLetter: "dead"}
+	b := pubsub.NewMemoryBroker()
+	if err := Peril(ex).Declare(b, nil); err != nil {
+		t.Fatal(err)
+	}
+	if diffs, err := Peril(ex).Diff(b, nil); err != nil || len(diffs) != 0 {
+		t.Fatalf("diff after declare: %v, %v", diffs, err)
+	}
+	for _, name := range []string{routing.ExchangePerilDirect, routing.ExchangePerilTopic, routing.ExchangePerilDead} {
+		// A failed passive declare closes its channel, so each gets its own.
+		ch, err := b.Channel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ch.ExchangeDeclarePassive(name, amqp.ExchangeTopic, true, false, false, false, nil); err == nil {
+			t.Errorf("default exchange %s declared", name)
+		}
+		ch.Close()
+	}
+
+	ch, err := b.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	// An intent published to the renamed topic exchange and rejected ends
+	// up in the dead letter queue through the renamed dead letter exchange.
+	if err := ch.PublishWithContext(context.Background(), "t", routing.IntentKey("bob"), false, false,
+		amqp.Publishing{Body: []byte("{}")}); err != nil {
+		t.Fatal(err)
+	}
+	d, ok, err := ch.Get(routing.IntentsPrefix, false)
+	if err != nil || !ok {
+		t.Fatalf("intent not routed: %v, %v", ok, err)
+	}
+	if err := d.Nack(false, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := ch.Get(routing.QueuePerilDead, true); err != nil || !ok {
+		t.Errorf("rejected intent not dead-lettered: %v, %v", ok, err)
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	b := pubsub.NewMemoryBroker()
+	peril := Peril(routing.DefaultExchanges())
+	if err := peril.Declare(b, nil); err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := peril.Diff(b, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != len(peril.Policies) {
+		t.Fatalf("diff without policies: %v, want every policy missing", diffs)
+	}
+	for _, d := range diffs {
+		if d.Kind != "policy" || d.Reason != "missing" {
+			t.Errorf("diff %s, want a missing policy", d)
+		}
+	}
+
+	if err := peril.Declare(b, b); err != nil {
+		t.Fatal(err)
+	}
+	if diffs, err := peril.Diff(b, b); err != nil || len(diffs) != 0 {
+		t.Fatalf("diff after declare: %v, %v", diffs, err)
+	}
+
+	// An operator's change is reported but not undone.
+	tuned := peril.Policies[0]
+	tuned.Queue.MaxLength = 500
+	if err := b.SetPolicy(tuned); err != nil {
+		t.Fatal(err)
+	}
+	if err := peril.Declare(b, b); err != nil {
+		t.Fatal(err)
+	}
+	diffs, err = peril.Diff(b, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 1 || diffs[0].Name != tuned.Name || diffs[0].Reason == "missing" {
+		t.Fatalf("diff after tuning: %v, want %s to differ", diffs, tuned.Name)
+	}
+	policies, _ := b.Policies()
+	for _, p := range policies {
+		if p.Name == tuned.Name && p != tuned {
+			t.Errorf("declare replaced the tuned policy with %+v", p)
+		}
+	}
+}
+
+// TestGameLogsCapped fills game_logs past a lowered peril-game-logs limit:
+// the oldest logs go to the dead letter queue.
+func TestGameLogsCapped(t *testing.T) {
+	b := pubsub.NewMemoryBroker()
+	peril := Peril(routing.DefaultExchanges())
+	for i, p := range peril.Policies {
+		if p.Name == "peril-game-logs" {
+			peril.Policies[i].Queue.MaxLength = 2
+		}
+	}
+	if err := peril.Declare(b, b); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := b.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	for _, body := range []string{"1", "2", "3"} {
+		if err := ch.PublishWithContext(context.Background(), routing.ExchangePerilTopic, routing.GameLogKey("bob"),
+			false, false, amqp.Publishing{Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(queue string) []string {
+		var bodies []string
+		for {
+			d, ok, err := ch.Get(queue, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				return bodies
+			}
+			bodies = append(bodies, string(d.Body))
+		}
+	}
+	if got := get(routing.GameLogSlug); len(got) != 2 || got[0] != "2" {
+		t.Errorf("game_logs holds %q, want the two newest", got)
+	}
+	if got := get(routing.QueuePerilDead); len(got) != 1 || got[0] != "1" {
+		t.Errorf("dead letter queue holds %q, want the oldest log", got)
+	}
+}
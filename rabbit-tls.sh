@@ -0,0 +1,114 @@
+#!/bin/bash
+
+# A TLS-only RabbitMQ for trying amqps and EXTERNAL auth locally. It listens
+# on 5671 only, with the management API on 15671 over https, has no guest
+# account, and logs clients in by the common name of their certificate.
+#
+#   ./rabbit-tls.sh certs            make a CA and a broker certificate
+#   ./rabbit-tls.sh client <name>    make a client certificate for <name>
+#   ./rabbit-tls.sh start            run the broker
+#   ./rabbit-tls.sh user <name>      create <name> on the running broker
+#   ./rabbit-tls.sh policymaker <name>
+#                                    give <name> a password for the management
+#                                    API, to set the queue policies with
+#
+# Then, for example:
+#   ./rabbit-tls.sh client server && ./rabbit-tls.sh user server
+#   ./rabbit-tls.sh policymaker server
+#   go run ./cmd/server -broker amqps://localhost:5671/ -auth external -secure \
+#       -tls-ca tls/ca.pem -tls-cert tls/server.pem -tls-key tls/server.key \
+#       -management https://server:<password>@localhost:15671/
+
+set -e
+
+dir=tls
+container=peril_rabbitmq_tls
+
+certs () {
+    mkdir -p "$dir"
+    openssl req -x509 -newkey rsa:2048 -nodes -days 365 -subj "/CN=Peril test CA" \
+        -keyout "$dir/ca.key" -out "$dir/ca.pem"
+    openssl req -newkey rsa:2048 -nodes -subj "/CN=peril-rabbit" \
+        -keyout "$dir/broker.key" -out "$dir/broker.csr"
+    openssl x509 -req -in "$dir/broker.csr" -CA "$dir/ca.pem" -CAkey "$dir/ca.key" \
+        -CAcreateserial -days 365 -out "$dir/broker.pem" \
+        -extfile <(printf "subjectAltName=DNS:localhost,DNS:peril-rabbit,IP:127.0.0.1\nextendedKeyUsage=serverAuth")
+    cat > "$dir/rabbitmq.conf" <<EOF
+listeners.tcp = none
+listeners.ssl.default = 5671
+ssl_options.cacertfile = /etc/rabbitmq/tls/ca.pem
+ssl_options.certfile = /etc/rabbitmq/tls/broker.pem
+ssl_options.keyfile = /etc/rabbitmq/tls/broker.key
+ssl_options.verify = verify_peer
+ssl_options.fail_if_no_peer_cert = true
+auth_mechanisms.1 = EXTERNAL
+ssl_cert_login_from = common_name
+management.ssl.port = 15671
+management.ssl.cacertfile = /etc/rabbitmq/tls/ca.pem
+management.ssl.certfile = /etc/rabbitmq/tls/broker.pem
+management.ssl.keyfile = /etc/rabbitmq/tls/broker.key
+default_user = peril-admin
+default_pass = $(openssl rand -hex 16)
+EOF
+    chmod 644 "$dir/broker.key"
+}
+
+client () {
+    openssl req -newkey rsa:2048 -nodes -subj "/CN=$1" \
+        -keyout "$dir/$1.key" -out "$dir/$1.csr"
+    openssl x509 -req -in "$dir/$1.csr" -CA "$dir/ca.pem" -CAkey "$dir/ca.key" \
+        -CAcreateserial -days 365 -out "$dir/$1.pem" \
+        -extfile <(printf "extendedKeyUsage=clientAuth")
+}
+
+start () {
+    docker run -d --name "$container" -p 5671:5671 -p 15671:15671 \
+        -v "$PWD/$dir:/etc/rabbitmq/tls:ro" \
+        -v "$PWD/$dir/rabbitmq.conf:/etc/rabbitmq/conf.d/20-tls.conf:ro" \
+        rabbitmq:3.13-management
+    sleep 5
+    docker exec "$container" rabbitmq-plugins enable rabbitmq_auth_mechanism_ssl
+}
+
+user () {
+    # EXTERNAL users need no password; the certificate is the credential.
+    docker exec "$container" rabbitmqctl add_user "$1" "$(openssl rand -hex 16)"
+    docker exec "$container" rabbitmqctl clear_password "$1"
+    docker exec "$container" rabbitmqctl set_permissions -p / "$1" ".*" ".*" ".*"
+}
+
+policymaker () {
+    # The management API has no certificate login, so this user gets a
+    # password after all, printed once.
+    pass=$(openssl rand -hex 16)
+    docker exec "$container" rabbitmqctl change_password "$1" "$pass"
+    docker exec "$container" rabbitmqctl set_user_tags "$1" policymaker
+    echo "$1's management API password: $pass"
+}
+
+case "$1" in
+    certs)
+        certs
+        ;;
+    client)
+        [ -n "$2" ] || { echo "Usage: $0 client <name>"; exit 1; }
+        client "$2"
+        ;;
+    start)
+        start
+        ;;
+    stop)
+        docker stop "$container" && docker rm "$container"
+        ;;
+    user)
+        [ -n "$2" ] || { echo "Usage: $0 user <name>"; exit 1; }
+        user "$2"
+        ;;
+    policymaker)
+        [ -n "$2" ] || { echo "Usage: $0 policymaker <name>"; exit 1; }
+        policymaker "$2"
+        ;;
+    *)
+        echo "Usage: $0 {certs|client <name>|start|stop|user <name>|policymaker <name>}"
+        exit 1
+esac
@@ -1,5 +1,8 @@
 #!/bin/bash
 
+# The server sets the queue policies (see internal/topology) through the
+# management API on port 15672, as guest.
+
 start_or_run () {
     docker inspect peril_rabbitmq > /dev/null 2>&1
 